@@ -0,0 +1,36 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// adminOnly guards operator endpoints with a static bearer token. With
+// no token configured the admin API is switched off entirely. Attempts
+// and calls both go to j's audit log, and failed attempts count towards
+// the caller's lockout and rate limit like any other bad credential.
+func adminOnly(token string, j *JWTAuth, next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			jsonError(w, http.StatusNotFound, "admin API disabled")
+			return
+		}
+		if lockedOut(j.Lockout, w, r, ipKey(r)) {
+			return
+		}
+		scheme, got, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") ||
+			subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			slog.Warn("admin auth", "addr", r.RemoteAddr, "path", r.URL.Path)
+			j.Audit.RecordFailure(r, "admin_auth_failure", "method", r.Method, "path", r.URL.Path)
+			j.Lockout.Fail(ipKey(r))
+			j.unauthorized(w, r, "admin token required")
+			return
+		}
+		slog.Info("admin", "method", r.Method, "path", r.URL.Path, "addr", r.RemoteAddr)
+		j.Audit.Record(r, "admin", "", "method", r.Method, "path", r.URL.Path)
+		next(w, r)
+	})
+}
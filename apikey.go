@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrBadAPIKey = errors.New("invalid or expired API key")
+
+// API keys look like mbk_<id>_<secret>. The id lets us find the record
+// without scanning; only a SHA-256 of the whole key is stored, which is
+// enough since the secret is 32 random bytes.
+const apiKeyPrefix = "mbk_"
+
+type APIKey struct {
+	ID      string    `json:"id"`
+	Hash    string    `json:"hash"`
+	Subject string    `json:"subject"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires,omitzero"`
+	Entitlements
+}
+
+func (k *APIKey) expired(now time.Time) bool {
+	return !k.Expires.IsZero() && now.After(k.Expires)
+}
+
+// APIKeyStore is the file-backed set of API keys. The CLI edits the file
+// while the server runs, so the server picks up changes by watching the
+// file's mtime.
+type APIKeyStore struct {
+	mu      sync.Mutex
+	path    string
+	keys    map[string]*APIKey
+	modTime time.Time
+}
+
+func OpenAPIKeyStore(path string) (*APIKeyStore, error) {
+	s := &APIKeyStore{path: path, keys: map[string]*APIKey{}}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.loadLocked(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *APIKeyStore) loadLocked() error {
+	keys := map[string]*APIKey{}
+	if err := readJSONFile(s.path, &keys); err != nil {
+		return err
+	}
+	s.keys = keys
+	if fi, err := os.Stat(s.path); err == nil {
+		s.modTime = fi.ModTime()
+	}
+	return nil
+}
+
+func (s *APIKeyStore) reloadIfChangedLocked() {
+	fi, err := os.Stat(s.path)
+	if err != nil || fi.ModTime().Equal(s.modTime) {
+		return
+	}
+	if err := s.loadLocked(); err != nil {
+		slog.Error("reload api keys", "err", err)
+		return
+	}
+	slog.Info("reloaded api keys", "count", len(s.keys))
+}
+
+func hashAPIKey(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create adds a key for sub and returns its plaintext, which is never
+// stored and can't be recovered later. A zero ttl never expires.
+func (s *APIKeyStore) Create(sub string, ent Entitlements, ttl time.Duration) (string, *APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reloadIfChangedLocked()
+
+	id := randomID(6)
+	raw := apiKeyPrefix + id + "_" + randomID(32)
+	k := &APIKey{
+		ID:           id,
+		Hash:         hashAPIKey(raw),
+		Subject:      sub,
+		Created:      time.Now().UTC(),
+		Entitlements: ent,
+	}
+	if ttl > 0 {
+		k.Expires = k.Created.Add(ttl)
+	}
+	s.keys[id] = k
+	if err := s.saveLocked(); err != nil {
+		delete(s.keys, id)
+		return "", nil, err
+	}
+	return raw, k, nil
+}
+
+func (s *APIKeyStore) List() []*APIKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reloadIfChangedLocked()
+
+	out := make([]*APIKey, 0, len(s.keys))
+	for _, k := range s.keys {
+		out = append(out, k)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Created.Before(out[j].Created) })
+	return out
+}
+
+func (s *APIKeyStore) Revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reloadIfChangedLocked()
+
+	if _, ok := s.keys[id]; !ok {
+		return fmt.Errorf("no such key %q", id)
+	}
+	delete(s.keys, id)
+	return s.saveLocked()
+}
+
+// Active reports whether the key id still exists and hasn't expired.
+func (s *APIKeyStore) Active(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reloadIfChangedLocked()
+	k, ok := s.keys[id]
+	return ok && !k.expired(time.Now())
+}
+
+// apiKeyID returns the id part of a raw key, without checking it.
+func apiKeyID(raw string) (string, bool) {
+	rest, ok := strings.CutPrefix(raw, apiKeyPrefix)
+	if !ok {
+		return "", false
+	}
+	id, _, ok := strings.Cut(rest, "_")
+	return id, ok && id != ""
+}
+
+func (s *APIKeyStore) Authenticate(raw string) (*APIKey, error) {
+	id, ok := apiKeyID(raw)
+	if !ok {
+		return nil, ErrBadAPIKey
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reloadIfChangedLocked()
+
+	k, ok := s.keys[id]
+	if !ok || k.expired(time.Now()) {
+		return nil, ErrBadAPIKey
+	}
+	if subtle.ConstantTimeCompare([]byte(hashAPIKey(raw)), []byte(k.Hash)) != 1 {
+		return nil, ErrBadAPIKey
+	}
+	return k, nil
+}
+
+func (s *APIKeyStore) saveLocked() error {
+	if err := writeJSONFile(s.path, s.keys); err != nil {
+		return err
+	}
+	if fi, err := os.Stat(s.path); err == nil {
+		s.modTime = fi.ModTime()
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPIKeyStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "apikeys.json")
+	store, err := OpenAPIKeyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, k, err := store.Create("cron", Entitlements{Roles: []string{"batch"}}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(raw, apiKeyPrefix+k.ID+"_") {
+		t.Errorf("unexpected key format %q", raw)
+	}
+
+	got, err := store.Authenticate(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Subject != "cron" || !got.HasRole("batch") {
+		t.Errorf("key = %+v", got)
+	}
+
+	for name, bad := range map[string]string{
+		"garbage":      "nope",
+		"wrong secret": apiKeyPrefix + k.ID + "_deadbeef",
+		"unknown id":   apiKeyPrefix + "ffffff_" + strings.Repeat("0", 64),
+	} {
+		if _, err := store.Authenticate(bad); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+
+	// Another process (the CLI) revokes the key; the server's store
+	// notices the file changed.
+	other, _ := OpenAPIKeyStore(path)
+	if err := other.Revoke(k.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Authenticate(raw); err == nil {
+		t.Error("revoked key still accepted")
+	}
+}
+
+func TestAPIKeyStore_Expiry(t *testing.T) {
+	store, _ := OpenAPIKeyStore(filepath.Join(t.TempDir(), "apikeys.json"))
+	raw, _, _ := store.Create("x", Entitlements{}, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if _, err := store.Authenticate(raw); err == nil {
+		t.Error("expired key accepted")
+	}
+}
+
+func TestMiddleware_APIKey(t *testing.T) {
+	auth := NewJWTAuth(testSecret)
+	auth.APIKeys, _ = OpenAPIKeyStore(filepath.Join(t.TempDir(), "apikeys.json"))
+	small, _, _ := auth.APIKeys.Create("thumbs", Entitlements{MaxPixels: 100 * 100}, 0)
+	big, _, _ := auth.APIKeys.Create("cron", Entitlements{}, 0)
+
+	var sub string
+	handler := withLogging(auth.Middleware(Authorize(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sub = identityFrom(r.Context()).Subject
+	}))))
+
+	cases := []struct {
+		name string
+		key  string
+		want int
+	}{
+		{"valid", big, 200},
+		{"over limit", small, 403},
+		{"bad key", "mbk_nope", 401},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/generate/", strings.NewReader(renderBody))
+			req.Header.Set("X-API-Key", tc.key)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tc.want {
+				t.Errorf("got %d, want %d", rec.Code, tc.want)
+			}
+		})
+	}
+	if sub != "cron" {
+		t.Errorf("identity subject = %q", sub)
+	}
+}
+
+func TestCLI_APIKey(t *testing.T) {
+	cfg := Config{DataDir: t.TempDir()}
+	run := func(args ...string) (int, string) {
+		var out, errOut bytes.Buffer
+		code := runCommand(cfg, args, &out, &errOut)
+		return code, out.String() + errOut.String()
+	}
+
+	if code, _ := run("apikey", "create"); code != 2 {
+		t.Errorf("create without --sub: exit %d", code)
+	}
+
+	code, out := run("apikey", "create", "--sub", "cron", "--role", "batch,nightly", "--ttl", "24h")
+	if code != 0 {
+		t.Fatalf("create: exit %d: %s", code, out)
+	}
+	var id string
+	for _, line := range strings.Split(out, "\n") {
+		if v, ok := strings.CutPrefix(line, "id:  "); ok {
+			id = v
+		}
+	}
+
+	code, out = run("apikey", "list")
+	if code != 0 || !strings.Contains(out, id) || !strings.Contains(out, "batch,nightly") {
+		t.Errorf("list: exit %d: %s", code, out)
+	}
+
+	if code, out = run("apikey", "revoke", id); code != 0 {
+		t.Errorf("revoke: exit %d: %s", code, out)
+	}
+	if code, _ = run("apikey", "revoke", id); code != 1 {
+		t.Errorf("second revoke: exit %d", code)
+	}
+	if code, _ = run("bogus"); code != 2 {
+		t.Errorf("unknown command: exit %d", code)
+	}
+}
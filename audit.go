@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AuditEntry is one line of the audit log. Hash covers the entry's JSON
+// with Hash left empty, and Prev is the previous entry's Hash, so editing,
+// dropping or reordering lines breaks the chain. The last seq and hash
+// are also kept in a ".head" file next to the log so that cutting lines
+// off the end shows up too. The head is saved on each flush, so entries
+// from the last few seconds before a crash can follow it.
+type AuditEntry struct {
+	Seq     uint64            `json:"seq"`
+	Time    time.Time         `json:"time"`
+	Event   string            `json:"event"`
+	Subject string            `json:"sub,omitempty"`
+	Addr    string            `json:"addr,omitempty"`
+	Detail  map[string]string `json:"detail,omitempty"`
+	Prev    string            `json:"prev"`
+	Hash    string            `json:"hash,omitempty"`
+}
+
+func (e AuditEntry) computeHash() string {
+	e.Hash = ""
+	data, _ := json.Marshal(e)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+type auditHead struct {
+	Seq  uint64 `json:"seq"`
+	Hash string `json:"hash"`
+}
+
+// maxFailureBatches caps the addresses failures are counted for between
+// flushes; past it they are counted together.
+const maxFailureBatches = 1000
+
+// AuditLog appends auth events to an append-only JSON lines file.
+// Entries are written as they happen but synced, along with the head, by
+// Flush. Failed credentials are counted per address and written as one
+// entry each flush, so a flood of them can't slow the log down for
+// everyone else.
+//
+// A nil *AuditLog is valid and records nothing.
+type AuditLog struct {
+	flushMu sync.Mutex // one Flush at a time
+
+	mu       sync.Mutex
+	f        *os.File
+	path     string
+	head     auditHead
+	size     int64 // of the log after our last write
+	dirty    bool  // head not yet saved
+	failures map[failureKey]*failureBatch
+}
+
+type failureKey struct{ event, addr string }
+
+type failureBatch struct {
+	first  time.Time
+	count  int
+	detail []string // from the first failure
+}
+
+func OpenAuditLog(path string) (*AuditLog, error) {
+	a := &AuditLog{path: path, failures: map[failureKey]*failureBatch{}}
+	if _, err := VerifyAuditLog(path); err != nil {
+		// Keep going: the break stays in the file for verify to find,
+		// and refusing to start would just lose the events to come.
+		slog.Error("audit log failed verification", "path", path, "err", err)
+	}
+	last, err := lastAuditEntry(path)
+	if err != nil {
+		return nil, err
+	}
+	if last != nil {
+		a.head = auditHead{Seq: last.Seq, Hash: last.Hash}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	a.f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open audit log: %w", err)
+	}
+	if fi, err := a.f.Stat(); err == nil {
+		a.size = fi.Size()
+	}
+	// Save the head now so a crash before the first flush doesn't leave
+	// a log without one.
+	if err := writeJSONFile(path+".head", a.head); err != nil {
+		a.f.Close()
+		return nil, fmt.Errorf("audit log head: %w", err)
+	}
+	return a, nil
+}
+
+func lastAuditEntry(path string) (*AuditEntry, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open audit log: %w", err)
+	}
+	defer f.Close()
+
+	var last *AuditEntry
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		var e AuditEntry
+		if json.Unmarshal(sc.Bytes(), &e) == nil {
+			last = &e
+		}
+	}
+	return last, sc.Err()
+}
+
+// Record appends an event. detail is a list of key/value pairs; empty
+// values are left out. Failures are logged rather than returned; auth
+// shouldn't stop because the audit disk is full.
+func (a *AuditLog) Record(r *http.Request, event, sub string, detail ...string) {
+	if a == nil {
+		return
+	}
+	e := AuditEntry{Time: time.Now().UTC(), Event: event, Subject: sub, Detail: auditDetail(detail)}
+	if r != nil {
+		e.Addr = r.RemoteAddr
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.appendLocked(e)
+}
+
+// RecordFailure counts a rejected credential from r's address. The count
+// is written by the next Flush as one entry, with the detail of the first
+// failure and when it happened.
+func (a *AuditLog) RecordFailure(r *http.Request, event string, detail ...string) {
+	if a == nil {
+		return
+	}
+	key := failureKey{event: event}
+	if r != nil {
+		key.addr = r.RemoteAddr
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			key.addr = host
+		}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	b, ok := a.failures[key]
+	if !ok && len(a.failures) >= maxFailureBatches {
+		key.addr = ""
+		b, ok = a.failures[key]
+	}
+	if !ok {
+		b = &failureBatch{first: time.Now().UTC(), detail: detail}
+		a.failures[key] = b
+	}
+	b.count++
+}
+
+func auditDetail(kv []string) map[string]string {
+	if len(kv) == 0 {
+		return nil
+	}
+	m := map[string]string{}
+	for i := 0; i+1 < len(kv); i += 2 {
+		if kv[i+1] != "" {
+			m[kv[i]] = kv[i+1]
+		}
+	}
+	return m
+}
+
+// appendLocked chains e onto the log. If another process (the CLI) has
+// appended since our last write, its entries are picked up first so the
+// chain stays unbroken.
+func (a *AuditLog) appendLocked(e AuditEntry) {
+	if fi, err := a.f.Stat(); err == nil && fi.Size() != a.size {
+		if last, err := lastAuditEntry(a.path); err == nil && last != nil {
+			a.head = auditHead{Seq: last.Seq, Hash: last.Hash}
+		}
+		a.size = fi.Size()
+	}
+	e.Seq, e.Prev = a.head.Seq+1, a.head.Hash
+	e.Hash = e.computeHash()
+	line, _ := json.Marshal(e)
+	n, err := a.f.Write(append(line, '\n'))
+	a.size += int64(n)
+	if err != nil {
+		slog.Error("audit log", "err", err, "event", e.Event)
+		return
+	}
+	a.head = auditHead{Seq: e.Seq, Hash: e.Hash}
+	a.dirty = true
+}
+
+// Flush writes out the failures counted since the last flush, syncs the
+// log and saves its head.
+func (a *AuditLog) Flush() {
+	if a == nil {
+		return
+	}
+	a.flushMu.Lock()
+	defer a.flushMu.Unlock()
+
+	a.mu.Lock()
+	keys := make([]failureKey, 0, len(a.failures))
+	for k := range a.failures {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return a.failures[keys[i]].first.Before(a.failures[keys[j]].first) })
+	now := time.Now().UTC()
+	for _, k := range keys {
+		b := a.failures[k]
+		detail := append(b.detail, "count", strconv.Itoa(b.count), "since", b.first.Format(time.RFC3339))
+		a.appendLocked(AuditEntry{Time: now, Event: k.event, Addr: k.addr, Detail: auditDetail(detail)})
+	}
+	clear(a.failures)
+	head, dirty := a.head, a.dirty
+	a.dirty = false
+	a.mu.Unlock()
+
+	if !dirty {
+		return
+	}
+	// The head must never get ahead of what is on disk.
+	err := a.f.Sync()
+	if err == nil {
+		err = writeJSONFile(a.path+".head", head)
+	}
+	if err != nil {
+		slog.Error("audit log flush", "err", err)
+		a.mu.Lock()
+		a.dirty = true
+		a.mu.Unlock()
+	}
+}
+
+// RunFlush flushes every interval until ctx is done.
+func (a *AuditLog) RunFlush(ctx context.Context, every time.Duration) {
+	tick := time.NewTicker(every)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			a.Flush()
+		}
+	}
+}
+
+// Close flushes the log and closes it.
+func (a *AuditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.Flush()
+	return a.f.Close()
+}
+
+// VerifyAuditLog checks the hash chain of the log at path and that it
+// still holds the entry its head file names. Entries after the head are
+// ones written since the last flush. It returns the number of entries
+// checked.
+func VerifyAuditLog(path string) (int, error) {
+	var head auditHead
+	if err := readJSONFile(path+".head", &head); err != nil {
+		return 0, err
+	}
+	_, headErr := os.Stat(path + ".head")
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		if head.Seq != 0 {
+			return 0, fmt.Errorf("log is missing but head is at seq %d", head.Seq)
+		}
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var prev AuditEntry
+	n, headSeen := 0, head.Seq == 0
+	rd := bufio.NewReader(bytes.NewReader(data))
+	for {
+		line, err := rd.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			break
+		}
+		n++
+		if err == io.EOF {
+			return n - 1, fmt.Errorf("line %d: incomplete entry", n)
+		}
+		var e AuditEntry
+		dec := json.NewDecoder(bytes.NewReader(line))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&e); err != nil {
+			return n - 1, fmt.Errorf("line %d: %w", n, err)
+		}
+		switch {
+		case e.Seq != prev.Seq+1:
+			return n - 1, fmt.Errorf("line %d: seq %d follows %d", n, e.Seq, prev.Seq)
+		case e.Prev != prev.Hash:
+			return n - 1, fmt.Errorf("line %d (seq %d): prev hash does not match seq %d", n, e.Seq, prev.Seq)
+		case e.Hash != e.computeHash():
+			return n - 1, fmt.Errorf("line %d (seq %d): entry was modified", n, e.Seq)
+		}
+		if e.Seq == head.Seq {
+			if e.Hash != head.Hash {
+				return n, fmt.Errorf("line %d (seq %d): does not match the head; the head was replaced", n, e.Seq)
+			}
+			headSeen = true
+		}
+		prev = e
+	}
+
+	switch {
+	case n > 0 && errors.Is(headErr, os.ErrNotExist):
+		return n, fmt.Errorf("head file is missing")
+	case !headSeen:
+		return n, fmt.Errorf("log ends at seq %d but head is at seq %d; entries were removed", prev.Seq, head.Seq)
+	}
+	return n, nil
+}
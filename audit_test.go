@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeAuditLog(t *testing.T, n int) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	a, err := OpenAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range n {
+		a.Record(nil, "test", "sub", "i", string(rune('a'+i)))
+	}
+	a.Close()
+	return path
+}
+
+func TestAuditLog_Verify(t *testing.T) {
+	edit := func(f func(lines []string) []string) func(string) {
+		return func(path string) {
+			data, _ := os.ReadFile(path)
+			lines := strings.SplitAfter(string(data), "\n")
+			os.WriteFile(path, []byte(strings.Join(f(lines[:len(lines)-1]), "")), 0o600)
+		}
+	}
+
+	cases := []struct {
+		name   string
+		tamper func(path string)
+		ok     bool
+	}{
+		{"untouched", func(string) {}, true},
+		{"edited", edit(func(l []string) []string {
+			l[1] = strings.Replace(l[1], `"sub":"sub"`, `"sub":"someone-else"`, 1)
+			return l
+		}), false},
+		{"line removed", edit(func(l []string) []string { return append(l[:1], l[2:]...) }), false},
+		{"reordered", edit(func(l []string) []string { l[1], l[2] = l[2], l[1]; return l }), false},
+		{"truncated", edit(func(l []string) []string { return l[:3] }), false},
+		{"partial write", func(path string) {
+			f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+			f.WriteString(`{"seq":6,`)
+			f.Close()
+		}, false},
+		{"head removed", func(path string) { os.Remove(path + ".head") }, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := writeAuditLog(t, 5)
+			tc.tamper(path)
+			n, err := VerifyAuditLog(path)
+			if tc.ok && (err != nil || n != 5) {
+				t.Errorf("n = %d, err = %v", n, err)
+			}
+			if !tc.ok && err == nil {
+				t.Error("tampering not detected")
+			}
+		})
+	}
+}
+
+func TestAuditLog_Reopen(t *testing.T) {
+	path := writeAuditLog(t, 2)
+	a, err := OpenAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Record(httptest.NewRequest("GET", "/", nil), "again", "")
+	a.Close()
+
+	if n, err := VerifyAuditLog(path); err != nil || n != 3 {
+		t.Errorf("n = %d, err = %v", n, err)
+	}
+}
+
+func TestAuditLog_Events(t *testing.T) {
+	auth, _ := newRevokingAuth(t)
+	path := filepath.Join(t.TempDir(), "audit.log")
+	auth.Audit, _ = OpenAuditLog(path)
+	defer auth.Audit.Close()
+
+	postJSON(auth.HandleToken, "/token", map[string]any{"subject": "alice"})
+	postJSON(auth.HandleRevoke, "/token/revoke", map[string]any{"subject": "alice"})
+	for range 3 {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer nope")
+		auth.Middleware(nil).ServeHTTP(httptest.NewRecorder(), req)
+	}
+	// Failures are counted until the next flush, then written once.
+	if got := auditEvents(t, path); got != "token_issued:alice subject_revoked:alice" {
+		t.Errorf("before flush: events = %q", got)
+	}
+	auth.Audit.Flush()
+	if got, want := auditEvents(t, path), "token_issued:alice subject_revoked:alice auth_failure:"; got != want {
+		t.Errorf("events = %q, want %q", got, want)
+	}
+	if e := lastAuditLine(t, path); e.Detail["count"] != "3" || e.Addr != "192.0.2.1" {
+		t.Errorf("failure entry = %+v", e)
+	}
+
+	cfg := Config{DataDir: filepath.Dir(path)}
+	var out bytes.Buffer
+	if code := runCommand(cfg, []string{"audit", "verify"}, &out, &out); code != 0 {
+		t.Errorf("audit verify: exit %d: %s", code, out.String())
+	}
+	os.Remove(path + ".head")
+	if code := runCommand(cfg, []string{"audit", "verify", path}, &out, &out); code != 1 {
+		t.Errorf("audit verify without head: exit %d", code)
+	}
+}
+
+func auditEvents(t *testing.T, path string) string {
+	t.Helper()
+	data, _ := os.ReadFile(path)
+	var events []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var e AuditEntry
+		json.Unmarshal([]byte(line), &e)
+		events = append(events, e.Event+":"+e.Subject)
+	}
+	return strings.Join(events, " ")
+}
+
+func lastAuditLine(t *testing.T, path string) *AuditEntry {
+	t.Helper()
+	e, err := lastAuditEntry(path)
+	if err != nil || e == nil {
+		t.Fatalf("last entry: %v, %v", e, err)
+	}
+	return e
+}
+
+func TestAuditLog_LazyHead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	a, _ := OpenAuditLog(path)
+	a.Record(nil, "one", "")
+	a.Flush()
+	a.Record(nil, "two", "")
+
+	// Entries since the last flush are fine; losing flushed ones is not.
+	if n, err := VerifyAuditLog(path); err != nil || n != 2 {
+		t.Errorf("unflushed tail: n = %d, err = %v", n, err)
+	}
+	data, _ := os.ReadFile(path)
+	os.WriteFile(path, []byte(""), 0o600)
+	if _, err := VerifyAuditLog(path); err == nil {
+		t.Error("emptied log passed")
+	}
+	os.WriteFile(path, data, 0o600)
+	a.Close()
+}
+
+func TestAuditLog_CLI(t *testing.T) {
+	cfg := Config{
+		DataDir:        t.TempDir(),
+		JWTSecret:      testSecret,
+		JWTIssuer:      defaultIssuer,
+		RequiredClaims: []string{"exp", "jti"},
+	}
+	path := filepath.Join(cfg.DataDir, "audit.log")
+
+	// The server has the log open while the CLI appends to it.
+	server, _ := OpenAuditLog(path)
+	server.Record(nil, "started", "")
+
+	var out bytes.Buffer
+	for _, args := range [][]string{
+		{"token", "issue", "--sub", "ops"},
+		{"apikey", "create", "--sub", "ci"},
+		{"apikey", "list"},
+	} {
+		if code := runCommand(cfg, args, &out, &out); code != 0 {
+			t.Fatalf("%v: exit %d: %s", args, code, out.String())
+		}
+	}
+	server.Record(nil, "after", "")
+	server.Close()
+
+	if got, want := auditEvents(t, path), "started: token_issued:ops apikey_created:ci after:"; got != want {
+		t.Errorf("events = %q, want %q", got, want)
+	}
+	if n, err := VerifyAuditLog(path); err != nil || n != 4 {
+		t.Errorf("n = %d, err = %v", n, err)
+	}
+}
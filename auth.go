@@ -2,88 +2,409 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"mime"
 	"net/http"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
+// Tokens never live longer than this, which also bounds how long a
+// rotated-out key has to keep verifying.
+const maxTokenTTL = 72 * time.Hour
+
+const defaultIssuer = "mandelbrot-auth-proxy"
+
 type JWTAuth struct {
-	secret []byte
+	keys *Keyring
+
+	// Issuer and Audience are stamped into every token we issue.
+	Issuer   string
+	Audience string
+	// Validate accepts tokens from any of AcceptIssuers (default: just
+	// Issuer) addressed to any of AcceptAudiences (default: Audience; no
+	// aud check if that is empty too).
+	AcceptIssuers   []string
+	AcceptAudiences []string
+	// RequiredClaims must be present in every token, e.g. "exp", "jti".
+	RequiredClaims []string
+	// Leeway tolerates clock skew on exp, nbf and iat.
+	Leeway time.Duration
+
+	// Revocations, when set, is consulted on every Validate.
+	Revocations *DenyList
+	// Refresh, when set, lets HandleToken hand out refresh tokens.
+	Refresh *RefreshStore
+	// Clients, when set, is required to authenticate POST /token.
+	Clients *ClientRegistry
+	// OIDC lists external IdPs whose tokens Middleware also accepts.
+	OIDC []*OIDCVerifier
+	// APIKeys, when set, lets Middleware accept X-API-Key instead of a
+	// bearer token.
+	APIKeys *APIKeyStore
+	// MTLS, when set, authenticates callers that present a client
+	// certificate and no other credential.
+	MTLS *MTLSAuth
+	// Lockout, when set, throttles callers that keep failing to
+	// authenticate.
+	Lockout *Lockout
+	// Presign, when set, signs GET /render links for POST /presign.
+	Presign *Presigner
+	// Audit, when set, records issuance, failed credentials and
+	// revocations.
+	Audit *AuditLog
+	// Limits, when set, is checked before POST /presign signs a render.
+	Limits *GenerateLimits
+	// RateLimit, when set, is charged by address for requests Middleware
+	// turns away, so they carry RateLimit headers like any other.
+	RateLimit *RateLimiter
 }
 
 func NewJWTAuth(secret string) *JWTAuth {
-	return &JWTAuth{secret: []byte(secret)}
+	return newJWTAuth(hmacKey([]byte(secret)))
+}
+
+// NewJWTAuthFromPEM signs with an RSA, ECDSA or Ed25519 private key so
+// that other services can verify tokens using only the published JWKS.
+func NewJWTAuthFromPEM(path string) (*JWTAuth, error) {
+	k, err := loadPrivateKey(path)
+	if err != nil {
+		return nil, err
+	}
+	return newJWTAuth(k), nil
+}
+
+// NewJWTAuthFromConfig builds the signer/verifier described by cfg. It
+// only sets up keys and validation rules; the optional stores are left to
+// the caller.
+func NewJWTAuthFromConfig(cfg Config) (*JWTAuth, error) {
+	auth := NewJWTAuth(cfg.JWTSecret)
+	if cfg.JWTPrivateKey != "" {
+		var err error
+		if auth, err = NewJWTAuthFromPEM(cfg.JWTPrivateKey); err != nil {
+			return nil, err
+		}
+	}
+	auth.Issuer, auth.Audience = cfg.JWTIssuer, cfg.JWTAudience
+	auth.AcceptIssuers, auth.AcceptAudiences = cfg.AcceptIssuers, cfg.AcceptAuds
+	auth.RequiredClaims, auth.Leeway = cfg.RequiredClaims, cfg.JWTLeeway
+	if cfg.DataDir != "" {
+		if err := auth.keys.Persist(filepath.Join(cfg.DataDir, "keyring.json")); err != nil {
+			return nil, err
+		}
+	}
+	return auth, nil
+}
+
+func newJWTAuth(k *signingKey) *JWTAuth {
+	return &JWTAuth{keys: NewKeyring(k, maxTokenTTL), Issuer: defaultIssuer}
 }
 
 func (j *JWTAuth) IssueToken(sub string, ttl time.Duration) (string, error) {
+	tok, _, err := j.issue(sub, Entitlements{}, ttl)
+	return tok, err
+}
+
+func (j *JWTAuth) issue(sub string, ent Entitlements, ttl time.Duration) (string, *Claims, error) {
+	key := j.keys.Current()
 	now := time.Now()
-	t := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-		Subject:   sub,
-		Issuer:    "mandelbrot-auth-proxy",
-		IssuedAt:  jwt.NewNumericDate(now),
-		ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
-	})
-	return t.SignedString(j.secret)
+	claims := &Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        randomID(16),
+			Subject:   sub,
+			Issuer:    j.Issuer,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+		},
+		Entitlements: ent,
+	}
+	if j.Audience != "" {
+		claims.Audience = jwt.ClaimStrings{j.Audience}
+	}
+	t := jwt.NewWithClaims(key.method, claims)
+	t.Header["kid"] = key.kid
+	tok, err := t.SignedString(key.sign)
+	return tok, claims, err
 }
 
-func (j *JWTAuth) Validate(raw string) (*jwt.RegisteredClaims, error) {
-	t, err := jwt.ParseWithClaims(raw, &jwt.RegisteredClaims{}, func(t *jwt.Token) (any, error) {
-		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+func (j *JWTAuth) Validate(raw string) (*Claims, error) {
+	t, err := jwt.ParseWithClaims(raw, &Claims{}, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		key, ok := j.keys.Lookup(kid)
+		if !ok {
+			return nil, fmt.Errorf("unknown or retired kid %q", kid)
+		}
+		if t.Method.Alg() != key.method.Alg() {
 			return nil, fmt.Errorf("unexpected alg %v", t.Header["alg"])
 		}
-		return j.secret, nil
-	})
+		return key.verify, nil
+	}, j.parserOptions()...)
 	if err != nil {
 		return nil, err
 	}
-	claims, ok := t.Claims.(*jwt.RegisteredClaims)
+	claims, ok := t.Claims.(*Claims)
 	if !ok || !t.Valid {
 		return nil, fmt.Errorf("invalid claims")
 	}
+	if err := j.checkIssuer(claims.Issuer); err != nil {
+		return nil, err
+	}
+	if err := checkRequired(raw, j.RequiredClaims); err != nil {
+		return nil, err
+	}
+	if j.Revocations != nil && j.Revocations.IsRevoked(&claims.RegisteredClaims) {
+		return nil, ErrRevoked
+	}
 	return claims, nil
 }
 
+func (j *JWTAuth) parserOptions() []jwt.ParserOption {
+	opts := []jwt.ParserOption{jwt.WithLeeway(j.Leeway), jwt.WithIssuedAt()}
+	auds := j.AcceptAudiences
+	if len(auds) == 0 && j.Audience != "" {
+		auds = []string{j.Audience}
+	}
+	if len(auds) > 0 {
+		opts = append(opts, jwt.WithAudience(auds...))
+	}
+	return opts
+}
+
+// checkIssuer is done by hand because jwt.WithIssuer takes exactly one.
+func (j *JWTAuth) checkIssuer(iss string) error {
+	accepted := j.AcceptIssuers
+	if len(accepted) == 0 {
+		accepted = []string{j.Issuer}
+	}
+	if !slices.Contains(accepted, iss) {
+		return fmt.Errorf("%w: issuer %q not accepted", jwt.ErrTokenInvalidIssuer, iss)
+	}
+	return nil
+}
+
+// checkRequired makes sure each named claim is present. The token has
+// already been verified, so reading the payload unverified is fine.
+func checkRequired(raw string, required []string) error {
+	if len(required) == 0 {
+		return nil
+	}
+	all := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(raw, all); err != nil {
+		return err
+	}
+	for _, name := range required {
+		if _, ok := all[name]; !ok {
+			return fmt.Errorf("%w: %s", jwt.ErrTokenRequiredClaimMissing, name)
+		}
+	}
+	return nil
+}
+
 func (j *JWTAuth) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := ipKey(r)
+		if lockedOut(j.Lockout, w, r, ip) {
+			return
+		}
+		// A success doesn't clear the address: failures there only age
+		// out, so one good credential can't launder guesses at others.
+		pass := func(id *Identity) {
+			next.ServeHTTP(w, authenticated(r, id))
+		}
+
+		if key := r.Header.Get("X-API-Key"); key != "" && j.APIKeys != nil {
+			// Also track the key id, so one key can't be guessed at from
+			// many addresses.
+			var keys []string
+			if kid, ok := apiKeyID(key); ok {
+				keys = append(keys, "apikey:"+kid)
+			}
+			if lockedOut(j.Lockout, w, r, keys...) {
+				return
+			}
+			k, err := j.APIKeys.Authenticate(key)
+			if err != nil {
+				j.authFailed(w, r, err, err.Error(), keys...)
+				return
+			}
+			j.Lockout.Succeed(keys...)
+			slog.Debug("authed", "sub", k.Subject, "key", k.ID, "path", r.URL.Path)
+			pass(&Identity{
+				Subject:      k.Subject,
+				Method:       "apikey",
+				KeyID:        k.ID,
+				Expires:      k.Expires,
+				Entitlements: k.Entitlements,
+			})
+			return
+		}
+
 		hdr := r.Header.Get("Authorization")
+		if hdr == "" && j.MTLS != nil && r.TLS != nil {
+			id, err := j.MTLS.Identify(r.TLS)
+			if err != nil {
+				j.authFailed(w, r, err, "client certificate rejected")
+				return
+			}
+			if id != nil {
+				slog.Debug("authed", "sub", id.Subject, "method", id.Method, "path", r.URL.Path)
+				pass(id)
+				return
+			}
+		}
 		if hdr == "" {
-			jsonError(w, http.StatusUnauthorized, "missing Authorization header")
+			j.unauthorized(w, r, "missing Authorization header")
 			return
 		}
 
 		scheme, token, ok := strings.Cut(hdr, " ")
 		if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
-			jsonError(w, http.StatusUnauthorized, "expected: Bearer <token>")
+			j.unauthorized(w, r, "expected: Bearer <token>")
 			return
 		}
 
-		claims, err := j.Validate(token)
+		claims, method, err := j.verifyBearer(token)
 		if err != nil {
-			slog.Warn("auth", "err", err, "addr", r.RemoteAddr, "path", r.URL.Path)
-			jsonError(w, http.StatusUnauthorized, "invalid or expired token")
+			msg := "invalid or expired token"
+			if errors.Is(err, ErrRevoked) {
+				msg = "token revoked"
+			}
+			j.authFailed(w, r, err, msg)
 			return
 		}
 
-		slog.Debug("authed", "sub", claims.Subject, "path", r.URL.Path)
-		next.ServeHTTP(w, r)
+		slog.Debug("authed", "sub", claims.Subject, "iss", claims.Issuer, "jti", claims.ID, "path", r.URL.Path)
+		id := &Identity{
+			Subject:      claims.Subject,
+			Method:       method,
+			TokenID:      claims.ID,
+			Entitlements: claims.Entitlements,
+		}
+		if claims.ExpiresAt != nil {
+			id.Expires = claims.ExpiresAt.Time
+		}
+		pass(id)
 	})
 }
 
-// POST /token — open for demo use. In production you'd gate this or
-// use an external IdP.
-func (j *JWTAuth) HandleToken(w http.ResponseWriter, r *http.Request) {
-	var req struct {
-		Subject  string `json:"subject"`
-		Duration string `json:"duration"`
+// authFailed logs a rejected credential, counts it towards the caller's
+// lockout, and that of any extra keys, and writes the 401.
+func (j *JWTAuth) authFailed(w http.ResponseWriter, r *http.Request, err error, msg string, keys ...string) {
+	slog.Warn("auth", "err", err, "addr", r.RemoteAddr, "path", r.URL.Path)
+	j.Audit.RecordFailure(r, "auth_failure", "path", r.URL.Path, "err", err.Error())
+	j.Lockout.Fail(append(keys, ipKey(r))...)
+	j.unauthorized(w, r, msg)
+}
+
+// unauthorized writes a 401, or a 429 if the caller's address is over its
+// rate limit.
+func (j *JWTAuth) unauthorized(w http.ResponseWriter, r *http.Request, msg string) {
+	if j.RateLimit.Allow(w, r) {
+		jsonError(w, http.StatusUnauthorized, msg)
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		jsonError(w, http.StatusBadRequest, "invalid JSON")
+}
+
+type tokenRequest struct {
+	Subject  string `json:"subject"`
+	Duration string `json:"duration"`
+	Refresh  bool   `json:"refresh"`
+
+	// Only accepted in form bodies; JSON callers use Basic auth.
+	clientID, clientSecret string
+}
+
+// parseTokenRequest accepts either the original JSON body or an
+// OAuth2-style application/x-www-form-urlencoded one.
+func parseTokenRequest(r *http.Request) (*tokenRequest, error) {
+	req := &tokenRequest{}
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if ct != "application/x-www-form-urlencoded" {
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			return nil, errors.New("invalid JSON")
+		}
+		return req, nil
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return nil, errors.New("invalid form body")
+	}
+	if gt := r.PostForm.Get("grant_type"); gt != "" && gt != "client_credentials" {
+		return nil, errors.New("unsupported grant_type: " + gt)
+	}
+	req.Subject = r.PostForm.Get("subject")
+	req.Duration = r.PostForm.Get("duration")
+	req.Refresh = r.PostForm.Get("refresh") == "true"
+	req.clientID = r.PostForm.Get("client_id")
+	req.clientSecret = r.PostForm.Get("client_secret")
+	return req, nil
+}
+
+// authenticateClient checks client credentials from Basic auth or, failing
+// that, the form body. Failures count against both the caller's address
+// and the client id, so one id can't be stuffed from many addresses. On
+// failure it has already written the 401 or 429 and returns false.
+func (j *JWTAuth) authenticateClient(w http.ResponseWriter, r *http.Request, realm, formID, formSecret string) (*Client, bool) {
+	id, secret, ok := r.BasicAuth()
+	if ok {
+		// RFC 6749 2.3.1: both halves are form-encoded before Basic.
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		id, secret = formID, formSecret
+	}
+
+	keys := []string{ipKey(r), "client:" + id}
+	if lockedOut(j.Lockout, w, r, keys...) {
+		return nil, false
+	}
+
+	c, err := j.Clients.Authenticate(id, secret)
+	if id == "" {
+		c, err = nil, ErrBadClient
+	}
+	if err != nil {
+		slog.Warn("client auth", "err", err, "client", id, "addr", r.RemoteAddr, "path", r.URL.Path)
+		j.Audit.RecordFailure(r, "client_auth_failure", "path", r.URL.Path, "client", id, "err", err.Error())
+		j.Lockout.Fail(keys...)
+		w.Header().Set("WWW-Authenticate", `Basic realm="`+realm+`"`)
+		jsonError(w, http.StatusUnauthorized, err.Error())
+		return nil, false
+	}
+	j.Lockout.Succeed("client:" + id)
+	return c, true
+}
+
+// POST /token. With a client registry configured the caller must present
+// client credentials and the token's subject is the client's, whatever
+// the body says. Without one it stays open for demo use.
+func (j *JWTAuth) HandleToken(w http.ResponseWriter, r *http.Request) {
+	req, err := parseTokenRequest(r)
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+
+	var ent Entitlements
+	var clientID string
+	if j.Clients != nil {
+		client, ok := j.authenticateClient(w, r, "token", req.clientID, req.clientSecret)
+		if !ok {
+			return
+		}
+		if req.Subject != "" && req.Subject != client.subject() {
+			slog.Debug("ignoring requested subject", "client", client.ID, "requested", req.Subject)
+		}
+		req.Subject = client.subject()
+		ent, clientID = client.Entitlements, client.ID
+	}
 	if req.Subject == "" {
 		req.Subject = "anonymous"
 	}
@@ -95,24 +416,44 @@ func (j *JWTAuth) HandleToken(w http.ResponseWriter, r *http.Request) {
 			jsonError(w, http.StatusBadRequest, "bad duration: "+req.Duration)
 			return
 		}
-		if d > 72*time.Hour {
-			d = 72 * time.Hour
+		if d > maxTokenTTL {
+			d = maxTokenTTL
 		}
 		ttl = d
 	}
 
-	tok, err := j.IssueToken(req.Subject, ttl)
+	if req.Refresh && j.Refresh == nil {
+		jsonError(w, http.StatusBadRequest, "refresh tokens not enabled")
+		return
+	}
+
+	tok, claims, err := j.issue(req.Subject, ent, ttl)
 	if err != nil {
 		slog.Error("issue token", "err", err)
 		jsonError(w, http.StatusInternalServerError, "token generation failed")
 		return
 	}
-
-	slog.Info("issued token", "sub", req.Subject, "ttl", ttl)
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
+	resp := map[string]string{
 		"token":      tok,
 		"expires_in": ttl.String(),
 		"subject":    req.Subject,
-	})
+	}
+
+	if req.Refresh {
+		rt, err := j.Refresh.Issue(req.Subject, ent)
+		if err != nil {
+			slog.Error("issue refresh token", "err", err)
+			jsonError(w, http.StatusInternalServerError, "token generation failed")
+			return
+		}
+		j.Refresh.bindAccess(rt, claims)
+		resp["refresh_token"] = rt
+	}
+
+	slog.Info("issued token", "sub", req.Subject, "ttl", ttl, "refresh", req.Refresh)
+	j.Audit.Record(r, "token_issued", req.Subject,
+		"jti", claims.ID, "exp", claims.ExpiresAt.Time.Format(time.RFC3339),
+		"client", clientID, "refresh", strconv.FormatBool(req.Refresh))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
 }
@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -156,3 +157,61 @@ func TestHandleToken(t *testing.T) {
 		}
 	})
 }
+
+func TestValidate_IssuerAudience(t *testing.T) {
+	prod := NewJWTAuth(testSecret)
+	prod.Audience = "render-prod"
+
+	staging := NewJWTAuth(testSecret)
+	staging.Audience = "render-staging"
+
+	other := NewJWTAuth(testSecret)
+	other.Issuer, other.Audience = "someone-else", "render-prod"
+
+	prodTok, _ := prod.IssueToken("alice", time.Hour)
+	stagingTok, _ := staging.IssueToken("alice", time.Hour)
+	otherTok, _ := other.IssueToken("alice", time.Hour)
+
+	if c, err := prod.Validate(prodTok); err != nil {
+		t.Fatal(err)
+	} else if len(c.Audience) != 1 || c.Audience[0] != "render-prod" {
+		t.Errorf("aud = %v", c.Audience)
+	}
+	if _, err := prod.Validate(stagingTok); !errors.Is(err, jwt.ErrTokenInvalidAudience) {
+		t.Errorf("cross-deployment replay: err = %v", err)
+	}
+	if _, err := prod.Validate(otherTok); !errors.Is(err, jwt.ErrTokenInvalidIssuer) {
+		t.Errorf("foreign issuer: err = %v", err)
+	}
+
+	// A deployment can be told to accept several.
+	prod.AcceptAudiences = []string{"render-prod", "render-staging"}
+	prod.AcceptIssuers = []string{defaultIssuer, "someone-else"}
+	for name, tok := range map[string]string{"staging": stagingTok, "other": otherTok} {
+		if _, err := prod.Validate(tok); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestValidate_RequiredClaimsAndLeeway(t *testing.T) {
+	auth := NewJWTAuth(testSecret)
+	auth.RequiredClaims = []string{"exp", "jti"}
+	now := time.Now()
+
+	noJTI, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		Subject: "x", Issuer: defaultIssuer, ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+	}).SignedString([]byte(testSecret))
+	if _, err := auth.Validate(noJTI); !errors.Is(err, jwt.ErrTokenRequiredClaimMissing) {
+		t.Errorf("missing jti: err = %v", err)
+	}
+
+	justExpired, _ := auth.IssueToken("x", -5*time.Second)
+	if _, err := auth.Validate(justExpired); err == nil {
+		t.Error("expired token accepted without leeway")
+	}
+	auth.Leeway = 30 * time.Second
+	if _, err := auth.Validate(justExpired); err != nil {
+		t.Errorf("within leeway: %v", err)
+	}
+}
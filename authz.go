@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+)
+
+// Authorize sits between Middleware and the proxy and checks /generate
+// bodies against the caller's entitlements. Everything else passes.
+func Authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := identityFrom(r.Context())
+		if id == nil || r.Method != http.MethodPost || !isGeneratePath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		req, err := readGenerateRequest(r)
+		if err != nil {
+			jsonError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if d := checkEntitlements(&id.Entitlements, req); d != nil {
+			slog.Warn("forbidden", "sub", id.Subject, "limit", d.Limit, "requested", d.Requested, "allowed", d.Allowed)
+			writeJSON(w, http.StatusForbidden, d)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// denial says which entitlement a request ran into.
+type denial struct {
+	Error     string `json:"error"`
+	Limit     string `json:"limit"`
+	Requested any    `json:"requested,omitempty"`
+	Allowed   any    `json:"allowed,omitempty"`
+}
+
+func checkEntitlements(e *Entitlements, req *GenerateRequest) *denial {
+	// Tokens without any scope predate scopes and aren't restricted.
+	if e.Scope != "" && !e.HasScope("generate") {
+		return &denial{Error: "token lacks the generate scope", Limit: "scope"}
+	}
+	if e.MaxPixels > 0 {
+		if req.Width < 1 || req.Height < 1 {
+			return &denial{Error: "width and height must be at least 1", Limit: "max_pixels"}
+		}
+		// Compared by division so a huge width*height can't wrap around
+		// and slip under the limit.
+		if req.Width > e.MaxPixels/req.Height {
+			d := &denial{
+				Error:   fmt.Sprintf("%dx%d exceeds max_pixels %d", req.Width, req.Height, e.MaxPixels),
+				Limit:   "max_pixels",
+				Allowed: e.MaxPixels,
+			}
+			if req.Width <= math.MaxInt64/req.Height {
+				px := req.Width * req.Height
+				d.Error = fmt.Sprintf("width*height = %d exceeds max_pixels %d", px, e.MaxPixels)
+				d.Requested = px
+			}
+			return d
+		}
+	}
+	if e.MaxIterations > 0 && req.Iterations > e.MaxIterations {
+		return &denial{
+			Error:     fmt.Sprintf("iterations %d exceeds max_iterations %d", req.Iterations, e.MaxIterations),
+			Limit:     "max_iterations",
+			Requested: req.Iterations,
+			Allowed:   e.MaxIterations,
+		}
+	}
+	if e.Region == nil && e.MaxZoom == 0 {
+		return nil
+	}
+
+	b := req.Bounds()
+	if !b.valid() {
+		// Inverted bounds would otherwise make the zoom negative and
+		// slip under any limit.
+		return &denial{Error: "re_max and im_max must be greater than re_min and im_min", Limit: "region"}
+	}
+	if e.Region != nil && !e.Region.Contains(b) {
+		return &denial{
+			Error:     "requested view is outside the allowed region",
+			Limit:     "region",
+			Requested: b,
+			Allowed:   *e.Region,
+		}
+	}
+	if z := req.Zoom(); e.MaxZoom > 0 && z > e.MaxZoom {
+		return &denial{
+			Error:     fmt.Sprintf("zoom %.4g exceeds max_zoom %g", z, e.MaxZoom),
+			Limit:     "max_zoom",
+			Requested: z,
+			Allowed:   e.MaxZoom,
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const renderBody = `{"width":640,"height":480,"iterations":100,"re_min":-2,"re_max":1,"im_min":-1,"im_max":1,"kind":"png"}`
+
+// zoomBody frames a square of the given side around the seahorse valley.
+func zoomBody(side float64) string {
+	return fmt.Sprintf(`{"width":64,"height":64,"re_min":%g,"re_max":%g,"im_min":%g,"im_max":%g}`,
+		-0.75, -0.75+side, 0.1, 0.1+side)
+}
+
+func TestAuthorize(t *testing.T) {
+	auth := NewJWTAuth(testSecret)
+
+	var forwarded string
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		forwarded = string(b)
+	})
+	handler := auth.Middleware(Authorize(upstream))
+
+	cases := []struct {
+		name  string
+		ent   Entitlements
+		body  string
+		want  int
+		limit string
+	}{
+		{"unlimited", Entitlements{}, renderBody, 200, ""},
+		{"within limits", Entitlements{MaxPixels: 640 * 480, MaxIterations: 100}, renderBody, 200, ""},
+		{"too many pixels", Entitlements{MaxPixels: 100_000}, renderBody, 403, "max_pixels"},
+		{"negative width", Entitlements{MaxPixels: 100_000}, `{"width":-640,"height":480}`, 403, "max_pixels"},
+		{"zero height", Entitlements{MaxPixels: 100_000}, `{"width":640,"height":0}`, 403, "max_pixels"},
+		{"product overflows", Entitlements{MaxPixels: 100_000}, `{"width":4294967296,"height":4294967296}`, 403, "max_pixels"},
+		{"too many iterations", Entitlements{MaxIterations: 50}, renderBody, 403, "max_iterations"},
+		{"scope ok", Entitlements{Scope: "read generate"}, renderBody, 200, ""},
+		{"scope missing", Entitlements{Scope: "read"}, renderBody, 403, "scope"},
+		{"bad json", Entitlements{}, `{nope`, 400, ""},
+		{"inside region", Entitlements{Region: &Region{-2.5, 1.5, -1.5, 1.5}}, renderBody, 200, ""},
+		{"outside region", Entitlements{Region: &Region{-1, 1, -1, 1}}, renderBody, 403, "region"},
+		{"zoom ok", Entitlements{MaxZoom: 10}, zoomBody(0.5), 200, ""},
+		{"zoom too deep", Entitlements{MaxZoom: 10}, zoomBody(0.01), 403, "max_zoom"},
+		{"inverted bounds", Entitlements{MaxZoom: 10}, `{"re_min":1,"re_max":-2,"im_min":-1,"im_max":1}`, 403, "region"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			forwarded = ""
+			tok, _, _ := auth.issue("alice", tc.ent, time.Hour)
+			req := httptest.NewRequest("POST", "/generate/", strings.NewReader(tc.body))
+			req.Header.Set("Authorization", "Bearer "+tok)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tc.want {
+				t.Fatalf("got %d, want %d: %s", rec.Code, tc.want, rec.Body)
+			}
+			if tc.want == 200 && forwarded != tc.body {
+				t.Errorf("upstream saw body %q", forwarded)
+			}
+			if tc.limit != "" {
+				var d denial
+				json.NewDecoder(rec.Body).Decode(&d)
+				if d.Limit != tc.limit || d.Error == "" {
+					t.Errorf("denial = %+v, want limit %s", d, tc.limit)
+				}
+			}
+		})
+	}
+}
+
+func TestAuthorize_OtherPathsPass(t *testing.T) {
+	auth := NewJWTAuth(testSecret)
+	tok, _, _ := auth.issue("alice", Entitlements{MaxPixels: 1}, time.Hour)
+	handler := auth.Middleware(Authorize(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {})))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+tok)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != 200 {
+		t.Errorf("status = %d", rec.Code)
+	}
+}
+
+func TestClaims_RoundTrip(t *testing.T) {
+	auth := NewJWTAuth(testSecret)
+	ent := Entitlements{Roles: []string{"student"}, Scope: "generate", MaxPixels: 10, MaxIterations: 20}
+	tok, _, _ := auth.issue("alice", ent, time.Hour)
+
+	c, err := auth.Validate(tok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.HasRole("student") || !c.HasScope("generate") || c.MaxPixels != 10 || c.MaxIterations != 20 {
+		t.Errorf("claims = %+v", c.Entitlements)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// replicaRunner is the part of DockerManager the autoscaler drives.
+type replicaRunner interface {
+	StartReplica(ctx context.Context) (*Replica, error)
+	Stop(ctx context.Context, id string) error
+	Replicas() []*Replica
+}
+
+// Autoscaler grows and shrinks the set of render containers between Min
+// and Max. Each tick it looks at how many requests are in flight across
+// the pool and how long /generate calls took since the last tick:
+//
+//   - more than TargetInflight requests per upstream, or a mean render
+//     time above TargetLatency, adds containers (enough to get back
+//     under TargetInflight, at least one);
+//   - comfortably under both removes one container, draining it first.
+//
+// UpCooldown and DownCooldown space out consecutive changes; scaling down
+// waits longer so a burst that pauses for a moment doesn't thrash.
+type Autoscaler struct {
+	Min, Max       int
+	TargetInflight int
+	TargetLatency  time.Duration
+	UpCooldown     time.Duration
+	DownCooldown   time.Duration
+	DrainTimeout   time.Duration
+
+	runner    replicaRunner
+	pool      *UpstreamPool
+	lastScale time.Time
+}
+
+func NewAutoscaler(runner replicaRunner, pool *UpstreamPool, min, max int) *Autoscaler {
+	return &Autoscaler{
+		Min:            min,
+		Max:            max,
+		TargetInflight: 4,
+		UpCooldown:     30 * time.Second,
+		DownCooldown:   5 * time.Minute,
+		DrainTimeout:   time.Minute,
+		runner:         runner,
+		pool:           pool,
+	}
+}
+
+func (a *Autoscaler) Run(ctx context.Context, every time.Duration) {
+	tick := time.NewTicker(every)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			a.Tick(ctx)
+		}
+	}
+}
+
+// Tick makes one scaling decision and carries it out.
+func (a *Autoscaler) Tick(ctx context.Context) {
+	replicas := a.runner.Replicas()
+	n := len(replicas)
+	outstanding := a.pool.Outstanding()
+	var inflight int64
+	for _, o := range outstanding {
+		inflight += o
+	}
+	latency, samples := a.pool.TakeLatency()
+
+	// Capacity counts every upstream, including ones we don't manage.
+	upstreams := max(len(outstanding), 1)
+	need := int((inflight + int64(a.TargetInflight) - 1) / int64(a.TargetInflight))
+	slow := a.TargetLatency > 0 && samples > 0 && latency > a.TargetLatency
+
+	since := time.Since(a.lastScale)
+	switch {
+	case n < a.Min:
+		a.scaleUp(ctx, a.Min-n, "below minimum")
+	case n < a.Max && (need > upstreams || slow) && since >= a.UpCooldown:
+		add := min(max(need-upstreams, 1), a.Max-n)
+		slog.Info("autoscale up", "replicas", n, "add", add, "inflight", inflight,
+			"queued", max(inflight-int64(upstreams*a.TargetInflight), 0), "latency", latency)
+		a.scaleUp(ctx, add, "load")
+	case n > a.Min && need < upstreams && !slow && since >= a.DownCooldown:
+		slog.Info("autoscale down", "replicas", n, "inflight", inflight, "latency", latency)
+		a.scaleDown(ctx, replicas, outstanding)
+	}
+}
+
+func (a *Autoscaler) scaleUp(ctx context.Context, count int, reason string) {
+	var wg sync.WaitGroup
+	for range count {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, err := a.runner.StartReplica(ctx)
+			if err != nil {
+				slog.Error("autoscale start", "err", err, "reason", reason)
+				return
+			}
+			a.pool.Add(r.URL())
+		}()
+	}
+	wg.Wait()
+	a.lastScale = time.Now()
+}
+
+// scaleDown drains and stops the least busy container.
+func (a *Autoscaler) scaleDown(ctx context.Context, replicas []*Replica, outstanding map[string]int64) {
+	victim := replicas[0]
+	for _, r := range replicas[1:] {
+		if outstanding[r.URL().String()] < outstanding[victim.URL().String()] {
+			victim = r
+		}
+	}
+	a.lastScale = time.Now()
+
+	dctx, cancel := context.WithTimeout(ctx, a.DrainTimeout)
+	defer cancel()
+	if err := a.pool.Drain(dctx, victim.URL()); err != nil {
+		// Stop it anyway; those requests get cut off.
+		slog.Warn("autoscale drain", "err", err, "name", victim.Name)
+	}
+	if err := a.runner.Stop(context.WithoutCancel(ctx), victim.ID); err != nil {
+		slog.Error("autoscale stop", "err", err, "name", victim.Name)
+	}
+}
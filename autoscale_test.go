@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeRunner stands in for DockerManager with httptest servers.
+type fakeRunner struct {
+	t        *testing.T
+	h        http.Handler
+	mu       sync.Mutex
+	servers  map[string]*httptest.Server
+	replicas map[string]*Replica
+
+	starts atomic.Int64
+	delay  time.Duration
+	fail   error
+}
+
+func newFakeRunner(t *testing.T, h http.HandlerFunc) *fakeRunner {
+	return &fakeRunner{t: t, h: h, servers: map[string]*httptest.Server{}, replicas: map[string]*Replica{}}
+}
+
+func (f *fakeRunner) StartReplica(context.Context) (*Replica, error) {
+	f.starts.Add(1)
+	time.Sleep(f.delay)
+	f.mu.Lock()
+	err := f.fail
+	f.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	srv := httptest.NewServer(f.h)
+	f.t.Cleanup(srv.Close)
+	id := randomID(6)
+	r := &Replica{ID: id, Name: "fake-" + id, Port: srv.Listener.Addr().(*net.TCPAddr).Port}
+	f.mu.Lock()
+	f.servers[id], f.replicas[id] = srv, r
+	f.mu.Unlock()
+	return r, nil
+}
+
+func (f *fakeRunner) Stop(_ context.Context, id string) error {
+	f.mu.Lock()
+	srv := f.servers[id]
+	delete(f.servers, id)
+	delete(f.replicas, id)
+	f.mu.Unlock()
+	srv.Close()
+	return nil
+}
+
+func (f *fakeRunner) Replicas() []*Replica {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var out []*Replica
+	for _, r := range f.replicas {
+		out = append(out, r)
+	}
+	return out
+}
+
+func TestAutoscaler(t *testing.T) {
+	release := make(chan struct{})
+	runner := newFakeRunner(t, func(w http.ResponseWriter, r *http.Request) {
+		if isGeneratePath(r.URL.Path) {
+			<-release
+		}
+	})
+	pool, _ := NewUpstreamPool(LeastOutstanding, nil, ":9090")
+	as := NewAutoscaler(runner, pool, 1, 3)
+	as.UpCooldown, as.DownCooldown = time.Hour, time.Hour
+	ctx := context.Background()
+
+	as.Tick(ctx)
+	if n := len(runner.Replicas()); n != 1 {
+		t.Fatalf("below minimum: %d replicas, want 1", n)
+	}
+
+	// 9 renders stuck on one upstream with a target of 4 each.
+	var wg sync.WaitGroup
+	for range 9 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pool.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/generate/", strings.NewReader("{}")))
+		}()
+	}
+	waitFor(t, func() bool { return pool.Outstanding()[runner.Replicas()[0].URL().String()] == 9 })
+
+	as.lastScale = time.Time{}
+	as.Tick(ctx)
+	if n := len(runner.Replicas()); n != 3 {
+		t.Fatalf("under load: %d replicas, want 3", n)
+	}
+	if n := len(pool.Outstanding()); n != 3 {
+		t.Errorf("pool has %d upstreams, want 3", n)
+	}
+
+	close(release)
+	wg.Wait()
+	as.Tick(ctx)
+	if n := len(runner.Replicas()); n != 3 {
+		t.Errorf("scaled down inside cooldown: %d replicas", n)
+	}
+
+	as.lastScale = time.Time{}
+	as.Tick(ctx)
+	if n := len(runner.Replicas()); n != 2 {
+		t.Errorf("idle: %d replicas, want 2", n)
+	}
+	if n := len(pool.Outstanding()); n != 2 {
+		t.Errorf("pool has %d upstreams, want 2", n)
+	}
+}
+
+func TestAutoscaler_Latency(t *testing.T) {
+	runner := newFakeRunner(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+	})
+	pool, _ := NewUpstreamPool(RoundRobin, nil, ":9090")
+	as := NewAutoscaler(runner, pool, 1, 2)
+	as.TargetLatency = 5 * time.Millisecond
+	as.UpCooldown = 0
+	as.Tick(context.Background())
+
+	pool.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/generate/", strings.NewReader("{}")))
+	as.Tick(context.Background())
+	if n := len(runner.Replicas()); n != 2 {
+		t.Errorf("slow renders: %d replicas, want 2", n)
+	}
+}
+
+func TestUpstreamPool_Drain(t *testing.T) {
+	release := make(chan struct{})
+	_, urls := newTestBackends(t, 1, func(w http.ResponseWriter, r *http.Request) { <-release })
+	pool, _ := NewUpstreamPool(RoundRobin, urls, ":9090")
+
+	go serveGET(pool, "/")
+	waitFor(t, func() bool { return pool.Outstanding()[urls[0].String()] == 1 })
+
+	drained := make(chan error)
+	go func() { drained <- pool.Drain(context.Background(), urls[0]) }()
+	select {
+	case <-drained:
+		t.Fatal("drain returned with a request in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if code := serveGET(pool, "/"); code != 503 {
+		t.Errorf("draining upstream still in rotation: status %d", code)
+	}
+	close(release)
+	if err := <-drained; err != nil {
+		t.Error(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	pool.Add(urls[0])
+	if err := pool.Drain(ctx, urls[0]); err != nil {
+		t.Errorf("idle drain: %v", err)
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
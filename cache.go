@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	renderCacheHits   = expvar.NewInt("render_cache_hits")
+	renderCacheMisses = expvar.NewInt("render_cache_misses")
+)
+
+// Renders bigger than this are passed through but never cached.
+const maxCachedRender = 32 << 20
+
+type cachedRender struct {
+	key         string
+	contentType string
+	body        []byte
+}
+
+func (e *cachedRender) size() int64 {
+	return int64(len(e.key) + len(e.contentType) + len(e.body))
+}
+
+// RenderCache keeps successful /generate images, keyed on the render
+// parameters rather than the exact bytes the client sent. Recently used
+// renders stay in memory up to MaxBytes; every render is also written
+// under dir (when set), which is trimmed back to maxDisk bytes, oldest
+// first, when it grows past that.
+type RenderCache struct {
+	MaxBytes int64
+
+	mu    sync.Mutex
+	lru   *list.List // of *cachedRender, most recent first
+	items map[string]*list.Element
+	bytes int64
+
+	dir       string
+	maxDisk   int64
+	diskMu    sync.Mutex
+	diskBytes int64
+}
+
+// NewRenderCache returns a cache holding up to maxBytes in memory. An
+// empty dir turns the disk tier off.
+func NewRenderCache(maxBytes int64, dir string, maxDisk int64) (*RenderCache, error) {
+	c := &RenderCache{
+		MaxBytes: maxBytes,
+		lru:      list.New(),
+		items:    map[string]*list.Element{},
+		dir:      dir,
+		maxDisk:  maxDisk,
+	}
+	if dir == "" {
+		return c, nil
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if info, err := d.Info(); err == nil {
+			c.diskBytes += info.Size()
+		}
+		return nil
+	})
+	return c, err
+}
+
+// renderKey hashes a canonical form of a /generate body: decoding and
+// re-encoding sorts the fields and normalises numbers, so 640, 640.0 and
+// 6.4e2 are the same render.
+func renderKey(body []byte) (string, error) {
+	var v map[string]any
+	if err := json.Unmarshal(body, &v); err != nil {
+		return "", err
+	}
+	canon, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(canon)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Handler answers POST /generate from the cache when it can, and fills
+// the cache from next when it can't. The X-Cache response header says
+// which happened.
+func (c *RenderCache) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || !isGeneratePath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		body, err := readGenerateBody(r)
+		if err != nil {
+			jsonError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		key, err := renderKey(body)
+		if err != nil {
+			// Not ours to judge; let the container reject it.
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if e := c.get(key); e != nil {
+			serveHit(w, r, e)
+			return
+		}
+
+		renderCacheMisses.Add(1)
+		w.Header().Set("X-Cache", "MISS")
+		cw := &captureWriter{ResponseWriter: w}
+		next.ServeHTTP(cw, r)
+		ct := w.Header().Get("Content-Type")
+		if cw.code == http.StatusOK && !cw.overflow && strings.HasPrefix(ct, "image/") {
+			c.put(&cachedRender{key: key, contentType: ct, body: cw.buf.Bytes()})
+		}
+	})
+}
+
+// captureWriter passes a response through while keeping a copy of the
+// body, up to maxCachedRender.
+type captureWriter struct {
+	http.ResponseWriter
+	code     int
+	buf      bytes.Buffer
+	overflow bool
+}
+
+func (cw *captureWriter) WriteHeader(code int) {
+	if cw.code == 0 {
+		cw.code = code
+	}
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *captureWriter) Write(b []byte) (int, error) {
+	if cw.code == 0 {
+		cw.code = http.StatusOK
+	}
+	if !cw.overflow {
+		if cw.buf.Len()+len(b) > maxCachedRender {
+			cw.overflow = true
+			cw.buf = bytes.Buffer{}
+		} else {
+			cw.buf.Write(b)
+		}
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach Flush on the real writer.
+func (cw *captureWriter) Unwrap() http.ResponseWriter { return cw.ResponseWriter }
+
+// serveCached answers r from the cache if the render body asks for is
+// there. A nil cache holds nothing.
+func (c *RenderCache) serveCached(w http.ResponseWriter, r *http.Request, body []byte) bool {
+	if c == nil {
+		return false
+	}
+	key, err := renderKey(body)
+	if err != nil {
+		return false
+	}
+	e := c.get(key)
+	if e == nil {
+		return false
+	}
+	serveHit(w, r, e)
+	return true
+}
+
+func serveHit(w http.ResponseWriter, r *http.Request, e *cachedRender) {
+	renderCacheHits.Add(1)
+	markSharedRender(r)
+	w.Header().Set("X-Cache", "HIT")
+	w.Header().Set("Content-Type", e.contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(e.body)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(e.body)
+}
+
+func (c *RenderCache) get(key string) *cachedRender {
+	c.mu.Lock()
+	if el, ok := c.items[key]; ok {
+		c.lru.MoveToFront(el)
+		c.mu.Unlock()
+		return el.Value.(*cachedRender)
+	}
+	c.mu.Unlock()
+
+	e := c.readDisk(key)
+	if e != nil {
+		c.remember(e)
+	}
+	return e
+}
+
+func (c *RenderCache) put(e *cachedRender) {
+	c.remember(e)
+	c.writeDisk(e)
+}
+
+// remember adds e to the in-memory tier, evicting the least recently used
+// renders to make room.
+func (c *RenderCache) remember(e *cachedRender) {
+	if e.size() > c.MaxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[e.key]; ok {
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.items[e.key] = c.lru.PushFront(e)
+	c.bytes += e.size()
+	for c.bytes > c.MaxBytes {
+		old := c.lru.Remove(c.lru.Back()).(*cachedRender)
+		delete(c.items, old.key)
+		c.bytes -= old.size()
+	}
+}
+
+// On disk a render is its content type, a newline, then the image.
+func (c *RenderCache) path(key string) string {
+	return filepath.Join(c.dir, key[:2], key)
+}
+
+func (c *RenderCache) readDisk(key string) *cachedRender {
+	if c.dir == "" {
+		return nil
+	}
+	path := c.path(key)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	ct, body, ok := bytes.Cut(data, []byte("\n"))
+	if !ok {
+		return nil
+	}
+	// Keep the oldest-first trim close to least recently used.
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return &cachedRender{key: key, contentType: string(ct), body: body}
+}
+
+func (c *RenderCache) writeDisk(e *cachedRender) {
+	if c.dir == "" {
+		return
+	}
+	path := c.path(e.key)
+	if _, err := os.Stat(path); err == nil {
+		return
+	}
+	data := append([]byte(e.contentType+"\n"), e.body...)
+	if err := writeFileAtomic(path, data); err != nil {
+		slog.Error("render cache write", "err", err)
+		return
+	}
+
+	c.diskMu.Lock()
+	defer c.diskMu.Unlock()
+	c.diskBytes += int64(len(data))
+	if c.maxDisk > 0 && c.diskBytes > c.maxDisk {
+		c.trimDisk()
+	}
+}
+
+// trimDisk removes the oldest renders until the disk tier is back under
+// 90% of maxDisk. Called with diskMu held.
+func (c *RenderCache) trimDisk() {
+	type file struct {
+		path  string
+		size  int64
+		mtime time.Time
+	}
+	var files []file
+	filepath.WalkDir(c.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			files = append(files, file{path, info.Size(), info.ModTime()})
+		}
+		return nil
+	})
+	sort.Slice(files, func(i, j int) bool { return files[i].mtime.Before(files[j].mtime) })
+
+	var total int64
+	for _, f := range files {
+		total += f.size
+	}
+	removed := 0
+	for _, f := range files {
+		if total <= c.maxDisk*9/10 {
+			break
+		}
+		if os.Remove(f.path) == nil {
+			total -= f.size
+			removed++
+		}
+	}
+	c.diskBytes = total
+	slog.Info("render cache trimmed", "removed", removed, "bytes", total)
+}
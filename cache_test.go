@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRenderKey(t *testing.T) {
+	base := `{"width":640,"height":480,"iterations":100,"re_min":-2,"re_max":1,"im_min":-1,"im_max":1,"kind":"png"}`
+	tests := []struct {
+		name string
+		body string
+		same bool
+	}{
+		{"field order", `{"kind":"png","height":480,"width":640,"iterations":100,"im_max":1,"im_min":-1,"re_max":1,"re_min":-2}`, true},
+		{"number formatting", `{"width":640.0,"height":4.8e2,"iterations":100,"re_min":-2.00,"re_max":1,"im_min":-1,"im_max":1.0,"kind":"png"}`, true},
+		{"whitespace", "{\n  \"width\": 640, \"height\": 480, \"iterations\": 100,\n  \"re_min\": -2, \"re_max\": 1, \"im_min\": -1, \"im_max\": 1, \"kind\": \"png\"\n}", true},
+		{"different iterations", `{"width":640,"height":480,"iterations":101,"re_min":-2,"re_max":1,"im_min":-1,"im_max":1,"kind":"png"}`, false},
+		{"different kind", `{"width":640,"height":480,"iterations":100,"re_min":-2,"re_max":1,"im_min":-1,"im_max":1,"kind":"jpeg"}`, false},
+	}
+	want, err := renderKey([]byte(base))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := renderKey([]byte(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (got == want) != tt.same {
+				t.Errorf("same key = %v, want %v", got == want, tt.same)
+			}
+		})
+	}
+	if _, err := renderKey([]byte("not json")); err == nil {
+		t.Error("expected error for invalid JSON")
+	}
+}
+
+// renderBackend counts renders and answers with a fake PNG, or with
+// status when the body asks for kind "fail".
+func renderBackend(renders *atomic.Int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		renders.Add(1)
+		if req, _ := readGenerateRequest(r); req != nil && req.Kind == "fail" {
+			http.Error(w, "boom", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("PNG:" + strings.Repeat("x", 100)))
+	})
+}
+
+func postGenerate(h http.Handler, path, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", path, strings.NewReader(body)))
+	return rec
+}
+
+func TestRenderCache(t *testing.T) {
+	var renders atomic.Int64
+	c, err := NewRenderCache(1<<20, t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := c.Handler(renderBackend(&renders))
+
+	steps := []struct {
+		path, body string
+		xcache     string
+		code       int
+		renders    int64
+	}{
+		{"/generate/", `{"width":10,"height":10,"kind":"png"}`, "MISS", 200, 1},
+		{"/generate/", `{"width":10,"height":10,"kind":"png"}`, "HIT", 200, 1},
+		{"/generate", `{"kind":"png","height":10.0,"width":1e1}`, "HIT", 200, 1},
+		{"/generate/", `{"width":20,"height":10,"kind":"png"}`, "MISS", 200, 2},
+		{"/generate/", `{"kind":"fail"}`, "MISS", 500, 3},
+		{"/generate/", `{"kind":"fail"}`, "MISS", 500, 4},
+		{"/generate/", `not json`, "", 200, 5},
+	}
+	for i, s := range steps {
+		rec := postGenerate(h, s.path, s.body)
+		if rec.Code != s.code || rec.Header().Get("X-Cache") != s.xcache {
+			t.Errorf("step %d: status %d, X-Cache %q; want %d, %q", i, rec.Code, rec.Header().Get("X-Cache"), s.code, s.xcache)
+		}
+		if n := renders.Load(); n != s.renders {
+			t.Errorf("step %d: %d renders, want %d", i, n, s.renders)
+		}
+	}
+
+	rec := postGenerate(h, "/generate/", `{"width":10,"height":10,"kind":"png"}`)
+	if ct := rec.Header().Get("Content-Type"); ct != "image/png" || !strings.HasPrefix(rec.Body.String(), "PNG:") {
+		t.Errorf("hit served %q, %q", ct, rec.Body.String())
+	}
+}
+
+func TestRenderCache_Tiers(t *testing.T) {
+	var renders atomic.Int64
+	dir := t.TempDir()
+	// Room in memory for one render only.
+	c, _ := NewRenderCache(200, dir, 1<<20)
+	h := c.Handler(renderBackend(&renders))
+
+	a, b := `{"width":1,"kind":"png"}`, `{"width":2,"kind":"png"}`
+	postGenerate(h, "/generate/", a)
+	postGenerate(h, "/generate/", b)
+	if len(c.items) != 1 {
+		t.Errorf("%d renders in memory, want 1", len(c.items))
+	}
+	// a was evicted from memory but comes back from disk.
+	if rec := postGenerate(h, "/generate/", a); rec.Header().Get("X-Cache") != "HIT" {
+		t.Error("evicted render not served from disk")
+	}
+
+	// A new cache over the same directory starts warm.
+	c2, _ := NewRenderCache(1<<20, dir, 1<<20)
+	if rec := postGenerate(c2.Handler(renderBackend(&renders)), "/generate/", b); rec.Header().Get("X-Cache") != "HIT" {
+		t.Error("render not kept across restarts")
+	}
+	if n := renders.Load(); n != 2 {
+		t.Errorf("%d renders, want 2", n)
+	}
+}
+
+func TestRenderCache_DiskLimit(t *testing.T) {
+	var renders atomic.Int64
+	c, _ := NewRenderCache(1<<20, t.TempDir(), 300)
+	h := c.Handler(renderBackend(&renders))
+	for _, w := range []string{"1", "2", "3", "4"} {
+		postGenerate(h, "/generate/", `{"width":`+w+`,"kind":"png"}`)
+	}
+	if c.diskBytes > 300 {
+		t.Errorf("disk tier holds %d bytes, limit 300", c.diskBytes)
+	}
+}
+
+func TestRenderCache_PassThrough(t *testing.T) {
+	var renders atomic.Int64
+	c, _ := NewRenderCache(1<<20, "", 0)
+	h := c.Handler(renderBackend(&renders))
+	for range 2 {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		if rec.Header().Get("X-Cache") != "" {
+			t.Error("X-Cache set on a non-render request")
+		}
+	}
+	if n := renders.Load(); n != 2 {
+		t.Errorf("%d requests reached the backend, want 2", n)
+	}
+}
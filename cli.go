@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// runCommand handles `mandelbrot-auth-proxy <command> ...`. With no
+// arguments main starts the server instead.
+func runCommand(cfg Config, args []string, stdout, stderr io.Writer) int {
+	switch args[0] {
+	case "apikey":
+		return apikeyCommand(cfg, args[1:], stdout, stderr)
+	case "token":
+		return tokenCommand(cfg, args[1:], stdout, stderr)
+	case "audit":
+		return auditCommand(cfg, args[1:], stdout, stderr)
+	case "help", "-h", "--help":
+		usage(stdout)
+		return 0
+	default:
+		fmt.Fprintf(stderr, "unknown command %q\n\n", args[0])
+		usage(stderr)
+		return 2
+	}
+}
+
+func usage(w io.Writer) {
+	fmt.Fprint(w, `usage: mandelbrot-auth-proxy [command]
+
+With no command, runs the proxy.
+
+commands:
+  apikey create --sub NAME [--role R,...] [--scope S] [--max-pixels N] [--max-iterations N] [--ttl D]
+  apikey list
+  apikey revoke ID
+  token issue --sub NAME [--ttl D] [--role R,...] [--scope S] [--max-pixels N] [--max-iterations N]
+  token inspect JWT
+  token verify JWT
+  audit verify [FILE]
+`)
+}
+
+func apikeyCommand(cfg Config, args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		usage(stderr)
+		return 2
+	}
+	store, err := OpenAPIKeyStore(filepath.Join(cfg.DataDir, "apikeys.json"))
+	if err != nil {
+		fmt.Fprintln(stderr, "api key store:", err)
+		return 1
+	}
+	audit, err := openCLIAudit(cfg, args[0])
+	if err != nil {
+		fmt.Fprintln(stderr, "audit log:", err)
+		return 1
+	}
+	defer audit.Close()
+
+	switch args[0] {
+	case "create":
+		fs := flag.NewFlagSet("apikey create", flag.ContinueOnError)
+		fs.SetOutput(stderr)
+		sub := fs.String("sub", "", "subject the key authenticates as")
+		ttl := fs.Duration("ttl", 0, "lifetime; 0 never expires")
+		ent := entitlementFlags(fs)
+		if err := fs.Parse(args[1:]); err != nil {
+			return 2
+		}
+		if *sub == "" {
+			fmt.Fprintln(stderr, "--sub is required")
+			return 2
+		}
+
+		raw, k, err := store.Create(*sub, ent(), *ttl)
+		if err != nil {
+			fmt.Fprintln(stderr, "create:", err)
+			return 1
+		}
+		exp := ""
+		if !k.Expires.IsZero() {
+			exp = k.Expires.Format(time.RFC3339)
+		}
+		audit.Record(nil, "apikey_created", k.Subject, "id", k.ID, "exp", exp, "via", "cli")
+		fmt.Fprintf(stdout, "id:  %s\nkey: %s\n\nThe key is not stored and cannot be shown again.\n", k.ID, raw)
+		return 0
+
+	case "list":
+		tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tSUBJECT\tROLES\tCREATED\tEXPIRES")
+		now := time.Now()
+		for _, k := range store.List() {
+			exp := "never"
+			if !k.Expires.IsZero() {
+				exp = k.Expires.Format(time.RFC3339)
+				if k.expired(now) {
+					exp += " (expired)"
+				}
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n",
+				k.ID, k.Subject, strings.Join(k.Roles, ","), k.Created.Format(time.RFC3339), exp)
+		}
+		tw.Flush()
+		return 0
+
+	case "revoke":
+		if len(args) != 2 {
+			fmt.Fprintln(stderr, "usage: apikey revoke ID")
+			return 2
+		}
+		if err := store.Revoke(args[1]); err != nil {
+			fmt.Fprintln(stderr, "revoke:", err)
+			return 1
+		}
+		audit.Record(nil, "apikey_revoked", "", "id", args[1], "via", "cli")
+		fmt.Fprintln(stdout, "revoked", args[1])
+		return 0
+
+	default:
+		fmt.Fprintf(stderr, "unknown apikey command %q\n", args[0])
+		return 2
+	}
+}
+
+// entitlementFlags registers the role/scope/limit flags shared by the
+// commands that mint credentials.
+func entitlementFlags(fs *flag.FlagSet) func() Entitlements {
+	roles := fs.String("role", "", "comma-separated roles")
+	scope := fs.String("scope", "", "space-separated scopes")
+	maxPixels := fs.Int64("max-pixels", 0, "max width*height; 0 is unlimited")
+	maxIter := fs.Int64("max-iterations", 0, "max iterations; 0 is unlimited")
+	maxZoom := fs.Float64("max-zoom", 0, "max zoom relative to the full set; 0 is unlimited")
+	var region *Region
+	fs.Func("region", "allowed box as re_min,re_max,im_min,im_max", func(s string) error {
+		var g Region
+		if _, err := fmt.Sscanf(s, "%g,%g,%g,%g", &g.ReMin, &g.ReMax, &g.ImMin, &g.ImMax); err != nil {
+			return err
+		}
+		if !g.valid() {
+			return fmt.Errorf("want re_min < re_max and im_min < im_max")
+		}
+		region = &g
+		return nil
+	})
+	return func() Entitlements {
+		e := Entitlements{Scope: *scope, MaxPixels: *maxPixels, MaxIterations: *maxIter, Region: region, MaxZoom: *maxZoom}
+		if *roles != "" {
+			e.Roles = strings.Split(*roles, ",")
+		}
+		return e
+	}
+}
+
+// openCLIAudit opens the server's audit log for commands that mint or
+// revoke credentials, so those are on record like the server's own. Other
+// commands get a nil log.
+func openCLIAudit(cfg Config, command string) (*AuditLog, error) {
+	switch command {
+	case "create", "revoke", "issue":
+		return OpenAuditLog(filepath.Join(cfg.DataDir, "audit.log"))
+	}
+	return nil, nil
+}
+
+func auditCommand(cfg Config, args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 || args[0] != "verify" || len(args) > 2 {
+		fmt.Fprintln(stderr, "usage: audit verify [FILE]")
+		return 2
+	}
+	path := filepath.Join(cfg.DataDir, "audit.log")
+	if len(args) == 2 {
+		path = args[1]
+	}
+	n, err := VerifyAuditLog(path)
+	if err != nil {
+		fmt.Fprintf(stdout, "%s: FAILED after %d good entries: %v\n", path, n, err)
+		return 1
+	}
+	fmt.Fprintf(stdout, "%s: ok, %d entries\n", path, n)
+	return 0
+}
+
+// tokenCommand mints and checks tokens with the same keys and validation
+// rules the server would use, so it needs JWT_SECRET or JWT_PRIVATE_KEY
+// to match the running proxy.
+func tokenCommand(cfg Config, args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		usage(stderr)
+		return 2
+	}
+	auth, err := NewJWTAuthFromConfig(cfg)
+	if err != nil {
+		fmt.Fprintln(stderr, "signing key:", err)
+		return 1
+	}
+
+	switch args[0] {
+	case "issue":
+		fs := flag.NewFlagSet("token issue", flag.ContinueOnError)
+		fs.SetOutput(stderr)
+		sub := fs.String("sub", "", "subject")
+		ttl := fs.Duration("ttl", time.Hour, "lifetime, at most "+maxTokenTTL.String())
+		ent := entitlementFlags(fs)
+		if err := fs.Parse(args[1:]); err != nil {
+			return 2
+		}
+		if *sub == "" {
+			fmt.Fprintln(stderr, "--sub is required")
+			return 2
+		}
+		if *ttl <= 0 || *ttl > maxTokenTTL {
+			fmt.Fprintf(stderr, "--ttl must be between 0 and %s\n", maxTokenTTL)
+			return 2
+		}
+		audit, err := openCLIAudit(cfg, args[0])
+		if err != nil {
+			fmt.Fprintln(stderr, "audit log:", err)
+			return 1
+		}
+		defer audit.Close()
+		tok, claims, err := auth.issue(*sub, ent(), *ttl)
+		if err != nil {
+			fmt.Fprintln(stderr, "issue:", err)
+			return 1
+		}
+		audit.Record(nil, "token_issued", claims.Subject,
+			"jti", claims.ID, "exp", claims.ExpiresAt.Time.Format(time.RFC3339), "via", "cli")
+		fmt.Fprintln(stdout, tok)
+		return 0
+
+	case "inspect", "verify":
+		if len(args) != 2 {
+			fmt.Fprintf(stderr, "usage: token %s JWT\n", args[0])
+			return 2
+		}
+		raw := strings.TrimSpace(args[1])
+		// Opening the deny list drops expired entries and saves it, as the
+		// server would at startup; nothing is revoked here.
+		auth.Revocations, err = OpenDenyList(filepath.Join(cfg.DataDir, "revocations.json"))
+		if err != nil {
+			fmt.Fprintln(stderr, "revocation store:", err)
+			return 1
+		}
+		if args[0] == "inspect" {
+			if !printToken(stdout, stderr, raw) {
+				return 1
+			}
+		}
+
+		claims, err := auth.Validate(raw)
+		if err != nil {
+			fmt.Fprintln(stdout, "invalid:", err)
+			return 1
+		}
+		fmt.Fprintf(stdout, "valid: sub=%s expires=%s\n", claims.Subject, claims.ExpiresAt.Time.Format(time.RFC3339))
+		return 0
+
+	default:
+		fmt.Fprintf(stderr, "unknown token command %q\n", args[0])
+		return 2
+	}
+}
+
+// printToken decodes raw without verifying it and prints its header and
+// claims.
+func printToken(stdout, stderr io.Writer, raw string) bool {
+	claims := jwt.MapClaims{}
+	t, _, err := jwt.NewParser().ParseUnverified(raw, claims)
+	if err != nil {
+		fmt.Fprintln(stderr, "decode:", err)
+		return false
+	}
+	header, _ := json.MarshalIndent(t.Header, "", "  ")
+	body, _ := json.MarshalIndent(claims, "", "  ")
+	fmt.Fprintf(stdout, "header: %s\nclaims: %s\n", header, body)
+	for _, c := range []struct {
+		name string
+		get  func() (*jwt.NumericDate, error)
+	}{
+		{"issued", claims.GetIssuedAt},
+		{"expires", claims.GetExpirationTime},
+	} {
+		if d, err := c.get(); err == nil && d != nil {
+			fmt.Fprintf(stdout, "%s: %s (%s)\n", c.name, d.Time.Format(time.RFC3339), relTime(d.Time))
+		}
+	}
+	return true
+}
+
+func relTime(t time.Time) string {
+	d := time.Until(t).Round(time.Second)
+	if d < 0 {
+		return (-d).String() + " ago"
+	}
+	return "in " + d.String()
+}
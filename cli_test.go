@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenCommand(t *testing.T) {
+	cfg := Config{
+		DataDir:        t.TempDir(),
+		JWTSecret:      testSecret,
+		JWTIssuer:      defaultIssuer,
+		RequiredClaims: []string{"exp", "jti"},
+	}
+	run := func(args ...string) (int, string) {
+		var out, errOut bytes.Buffer
+		code := runCommand(cfg, args, &out, &errOut)
+		return code, out.String() + errOut.String()
+	}
+
+	if code, _ := run("token", "issue"); code != 2 {
+		t.Errorf("issue without --sub: exit %d", code)
+	}
+	if code, _ := run("token", "issue", "--sub", "x", "--ttl", "100h"); code != 2 {
+		t.Errorf("issue over max ttl: exit %d", code)
+	}
+
+	code, tok := run("token", "issue", "--sub", "ops", "--scope", "generate", "--max-pixels", "500", "--ttl", "10m")
+	if code != 0 {
+		t.Fatalf("issue: exit %d: %s", code, tok)
+	}
+	tok = strings.TrimSpace(tok)
+
+	// The server must accept what the CLI minted.
+	server := NewJWTAuth(testSecret)
+	claims, err := server.Validate(tok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "ops" || claims.Scope != "generate" || claims.MaxPixels != 500 {
+		t.Errorf("claims = %+v", claims)
+	}
+
+	code, out := run("token", "inspect", tok)
+	if code != 0 || !strings.Contains(out, `"max_pixels": 500`) || !strings.Contains(out, "valid: sub=ops") {
+		t.Errorf("inspect: exit %d:\n%s", code, out)
+	}
+
+	if code, out := run("token", "verify", tok); code != 0 {
+		t.Errorf("verify: exit %d: %s", code, out)
+	}
+	other, _ := NewJWTAuth("other").IssueToken("ops", time.Hour)
+	if code, _ := run("token", "verify", other); code != 1 {
+		t.Errorf("verify foreign token: exit %d", code)
+	}
+	if code, out := run("token", "inspect", other); code != 1 || !strings.Contains(out, `"sub": "ops"`) {
+		t.Errorf("inspect foreign token: exit %d:\n%s", code, out)
+	}
+	if code, _ := run("token", "inspect", "garbage"); code != 1 {
+		t.Errorf("inspect garbage: exit %d", code)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrBadClient = errors.New("invalid client credentials")
+
+// Client is one entry in the clients file. Secrets are stored as bcrypt
+// ($2a$/$2b$/$2y$) or argon2id PHC strings, never in the clear.
+type Client struct {
+	ID         string `json:"id"`
+	SecretHash string `json:"secret_hash"`
+	// Subject stamped into tokens issued to this client. Defaults to ID.
+	Subject string `json:"subject,omitempty"`
+	// Roles, scope and render limits granted to the client's tokens.
+	Entitlements
+}
+
+func (c *Client) subject() string {
+	if c.Subject != "" {
+		return c.Subject
+	}
+	return c.ID
+}
+
+type ClientRegistry struct {
+	clients map[string]*Client
+}
+
+// LoadClients reads a JSON array of Client from path.
+func LoadClients(path string) (*ClientRegistry, error) {
+	var list []*Client
+	if err := readJSONFile(path, &list); err != nil {
+		return nil, err
+	}
+	cr := &ClientRegistry{clients: map[string]*Client{}}
+	for _, c := range list {
+		if c.ID == "" || c.SecretHash == "" {
+			return nil, fmt.Errorf("%s: client entries need id and secret_hash", path)
+		}
+		if err := checkSecretHash(c.SecretHash); err != nil {
+			return nil, fmt.Errorf("%s: client %q: %w", path, c.ID, err)
+		}
+		if _, dup := cr.clients[c.ID]; dup {
+			return nil, fmt.Errorf("%s: duplicate client %q", path, c.ID)
+		}
+		cr.clients[c.ID] = c
+	}
+	return cr, nil
+}
+
+// Used when the client id is unknown so that a miss costs about the same
+// as a wrong secret and doesn't reveal which ids exist.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+
+func (cr *ClientRegistry) Authenticate(id, secret string) (*Client, error) {
+	c, ok := cr.clients[id]
+	if !ok {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(secret))
+		return nil, ErrBadClient
+	}
+	if !checkSecret(c.SecretHash, secret) {
+		return nil, ErrBadClient
+	}
+	return c, nil
+}
+
+func checkSecret(hash, secret string) bool {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		return checkArgon2id(hash, secret)
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(secret)) == nil
+}
+
+// checkSecretHash rejects hashes that checkSecret can't safely use, so a
+// bad entry stops startup instead of panicking or exhausting memory on the
+// first login.
+func checkSecretHash(hash string) error {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		_, err := parseArgon2id(hash)
+		return err
+	}
+	if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+		return fmt.Errorf("secret_hash: %w", err)
+	}
+	return nil
+}
+
+// Upper bound on an argon2id hash's memory cost, in KiB.
+const maxArgon2Memory = 256 << 10
+
+type argon2Params struct {
+	mem, iters uint32
+	par        uint8
+	salt, hash []byte
+}
+
+// parseArgon2id reads a PHC string of the form
+// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash> (unpadded base64).
+func parseArgon2id(phc string) (*argon2Params, error) {
+	parts := strings.Split(phc, "$")
+	if len(parts) != 6 || parts[2] != "v=19" {
+		return nil, errors.New("secret_hash: not an argon2id v=19 PHC string")
+	}
+	h := &argon2Params{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.mem, &h.iters, &h.par); err != nil {
+		return nil, fmt.Errorf("secret_hash: bad argon2id parameters %q", parts[3])
+	}
+	if h.iters < 1 || h.par < 1 || h.mem < 8*uint32(h.par) || h.mem > maxArgon2Memory {
+		return nil, fmt.Errorf("secret_hash: argon2id parameters %q out of range", parts[3])
+	}
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil || len(h.salt) == 0 {
+		return nil, errors.New("secret_hash: bad argon2id salt")
+	}
+	if h.hash, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(h.hash) < 16 {
+		return nil, errors.New("secret_hash: argon2id hash must be at least 16 bytes")
+	}
+	return h, nil
+}
+
+func checkArgon2id(phc, secret string) bool {
+	h, err := parseArgon2id(phc)
+	if err != nil {
+		return false
+	}
+	got := argon2.IDKey([]byte(secret), h.salt, h.iters, h.mem, h.par, uint32(len(h.hash)))
+	return subtle.ConstantTimeCompare(got, h.hash) == 1
+}
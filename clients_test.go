@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func argon2idHash(secret string) string {
+	salt := []byte("0123456789abcdef")
+	sum := argon2.IDKey([]byte(secret), salt, 1, 8*1024, 1, 32)
+	return fmt.Sprintf("$argon2id$v=19$m=%d,t=%d,p=%d$%s$%s", 8*1024, 1, 1,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(sum))
+}
+
+func writeClients(t *testing.T, clients []Client) string {
+	t.Helper()
+	data, _ := json.Marshal(clients)
+	path := filepath.Join(t.TempDir(), "clients.json")
+	os.WriteFile(path, data, 0o600)
+	return path
+}
+
+func newClientAuth(t *testing.T) *JWTAuth {
+	t.Helper()
+	bc, _ := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	reg, err := LoadClients(writeClients(t, []Client{
+		{ID: "renderer", SecretHash: string(bc), Subject: "svc-renderer"},
+		{ID: "dashboard", SecretHash: argon2idHash("hunter2")},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := NewJWTAuth(testSecret)
+	auth.Clients = reg
+	return auth
+}
+
+func TestClientRegistry_Authenticate(t *testing.T) {
+	auth := newClientAuth(t)
+	cases := []struct {
+		id, secret string
+		ok         bool
+	}{
+		{"renderer", "s3cret", true},
+		{"renderer", "wrong", false},
+		{"dashboard", "hunter2", true},
+		{"dashboard", "hunter3", false},
+		{"nobody", "s3cret", false},
+	}
+	for _, tc := range cases {
+		_, err := auth.Clients.Authenticate(tc.id, tc.secret)
+		if (err == nil) != tc.ok {
+			t.Errorf("%s/%s: err = %v", tc.id, tc.secret, err)
+		}
+	}
+}
+
+func TestLoadClients_Errors(t *testing.T) {
+	bc, _ := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	salt := base64.RawStdEncoding.EncodeToString([]byte("0123456789abcdef"))
+	sum := base64.RawStdEncoding.EncodeToString(make([]byte, 32))
+	for name, clients := range map[string][]Client{
+		"no hash":          {{ID: "x"}},
+		"duplicate":        {{ID: "x", SecretHash: string(bc)}, {ID: "x", SecretHash: string(bc)}},
+		"not a hash":       {{ID: "x", SecretHash: "h"}},
+		"argon2id t=0":     {{ID: "x", SecretHash: "$argon2id$v=19$m=16,t=0,p=1$" + salt + "$" + sum}},
+		"argon2id p=0":     {{ID: "x", SecretHash: "$argon2id$v=19$m=16,t=1,p=0$" + salt + "$" + sum}},
+		"argon2id empty":   {{ID: "x", SecretHash: "$argon2id$v=19$m=16,t=1,p=1$c2FsdHNhbHQ$"}},
+		"argon2id huge m":  {{ID: "x", SecretHash: "$argon2id$v=19$m=4294967295,t=1,p=1$" + salt + "$" + sum}},
+		"argon2id no salt": {{ID: "x", SecretHash: "$argon2id$v=19$m=16,t=1,p=1$$" + sum}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := LoadClients(writeClients(t, clients)); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
+
+func TestHandleToken_ClientCredentials(t *testing.T) {
+	auth := newClientAuth(t)
+
+	t.Run("basic auth binds subject", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/token", strings.NewReader(`{"subject":"root"}`))
+		req.SetBasicAuth("renderer", "s3cret")
+		rec := httptest.NewRecorder()
+		auth.HandleToken(rec, req)
+		if rec.Code != 200 {
+			t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+		}
+		var resp map[string]string
+		json.NewDecoder(rec.Body).Decode(&resp)
+		claims, err := auth.Validate(resp["token"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claims.Subject != "svc-renderer" {
+			t.Errorf("subject = %q, want svc-renderer", claims.Subject)
+		}
+	})
+
+	t.Run("form body", func(t *testing.T) {
+		form := url.Values{
+			"grant_type":    {"client_credentials"},
+			"client_id":     {"dashboard"},
+			"client_secret": {"hunter2"},
+		}
+		req := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		auth.HandleToken(rec, req)
+		if rec.Code != 200 {
+			t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+		}
+		var resp map[string]string
+		json.NewDecoder(rec.Body).Decode(&resp)
+		if resp["subject"] != "dashboard" {
+			t.Errorf("subject = %q", resp["subject"])
+		}
+	})
+
+	t.Run("rejects", func(t *testing.T) {
+		noCreds := httptest.NewRequest("POST", "/token", strings.NewReader(`{}`))
+
+		wrongSecret := httptest.NewRequest("POST", "/token", strings.NewReader(`{}`))
+		wrongSecret.SetBasicAuth("renderer", "nope")
+
+		badGrant := httptest.NewRequest("POST", "/token", strings.NewReader("grant_type=password"))
+		badGrant.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		cases := []struct {
+			name string
+			req  *http.Request
+			want int
+		}{
+			{"no credentials", noCreds, 401},
+			{"wrong secret", wrongSecret, 401},
+			{"bad grant type", badGrant, 400},
+		}
+		for _, tc := range cases {
+			t.Run(tc.name, func(t *testing.T) {
+				rec := httptest.NewRecorder()
+				auth.HandleToken(rec, tc.req)
+				if rec.Code != tc.want {
+					t.Errorf("got %d, want %d", rec.Code, tc.want)
+				}
+			})
+		}
+	})
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"expvar"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var renderCoalesced = expvar.NewInt("render_coalesced")
+
+// An upstream render shared by several clients gives up after this long.
+const coalesceTimeout = 2 * time.Minute
+
+// renderCall is one upstream /generate request and everyone waiting on it.
+type renderCall struct {
+	done chan struct{}
+	resp *bufferedResponse // set once; the leader may release it at any time
+	li   logInfo
+	// aborted is set if the upstream died after the leader had been
+	// sent part of the body.
+	aborted bool
+}
+
+// bufferedResponse holds a response so it can be replayed to each
+// waiting client. A body bigger than max isn't kept: it goes straight to
+// the leader, the client that started the render, if it is still there,
+// and the others have to fetch their own.
+type bufferedResponse struct {
+	code   int
+	header http.Header
+	body   bytes.Buffer
+	max    int
+
+	mu       sync.Mutex
+	leader   http.ResponseWriter // nil once the leader has gone
+	overflow bool                // the body outgrew max
+	streamed bool                // and went to the leader instead
+}
+
+var errLeaderGone = errors.New("render too large to share and its client has gone")
+
+func newBufferedResponse(leader http.ResponseWriter, max int) *bufferedResponse {
+	return &bufferedResponse{header: http.Header{}, max: max, leader: leader}
+}
+
+func (b *bufferedResponse) Header() http.Header { return b.header }
+
+func (b *bufferedResponse) WriteHeader(code int) {
+	if b.code == 0 {
+		b.code = code
+	}
+}
+
+// truncated reports a body shorter than the upstream said it would be.
+func (b *bufferedResponse) truncated() bool {
+	cl, err := strconv.Atoi(b.header.Get("Content-Length"))
+	return err == nil && cl != b.body.Len()
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.code == 0 {
+		b.code = http.StatusOK
+	}
+	if !b.overflow && b.body.Len()+len(p) <= b.max {
+		return b.body.Write(p)
+	}
+	if !b.overflow {
+		b.overflow = true
+		slog.Debug("render too large to coalesce", "max", b.max)
+	}
+	if b.leader == nil {
+		return 0, errLeaderGone
+	}
+	if !b.streamed {
+		b.streamed = true
+		maps.Copy(b.leader.Header(), b.header)
+		b.leader.WriteHeader(b.code)
+		_, err := b.leader.Write(b.body.Bytes())
+		b.body = bytes.Buffer{}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return b.leader.Write(p)
+}
+
+// reset drops whatever the upstream managed to send, so an error can be
+// written in its place.
+func (b *bufferedResponse) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.code, b.header = 0, http.Header{}
+	b.body.Reset()
+}
+
+// release stops writes reaching the leader, which is about to return.
+func (b *bufferedResponse) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.leader = nil
+}
+
+// Coalescer sends concurrent /generate requests for the same render
+// upstream once and gives every caller a copy of the response.
+//
+// The upstream request runs detached from whichever client started it:
+// if that client hangs up, the others still get their image. A client
+// that hangs up only stops waiting itself. Upstream errors are shared
+// like any other response.
+type Coalescer struct {
+	next http.Handler
+	// MaxBuffer caps the response held for sharing; renders bigger than
+	// that stream to the first client and the rest go upstream alone.
+	MaxBuffer int
+
+	mu       sync.Mutex
+	inflight map[string]*renderCall
+}
+
+func Coalesce(next http.Handler) *Coalescer {
+	return &Coalescer{next: next, MaxBuffer: maxCachedRender, inflight: map[string]*renderCall{}}
+}
+
+func (c *Coalescer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || !isGeneratePath(r.URL.Path) {
+		c.next.ServeHTTP(w, r)
+		return
+	}
+	body, err := readGenerateBody(r)
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	key, err := renderKey(body)
+	if err != nil {
+		c.next.ServeHTTP(w, r)
+		return
+	}
+
+	c.mu.Lock()
+	call, follower := c.inflight[key]
+	if follower {
+		renderCoalesced.Add(1)
+	} else {
+		call = &renderCall{done: make(chan struct{}), resp: newBufferedResponse(w, c.MaxBuffer)}
+		c.inflight[key] = call
+		go c.run(key, call, r, body)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-r.Context().Done():
+		if !follower {
+			call.resp.release()
+		}
+		return
+	case <-call.done:
+	}
+
+	if call.resp.overflow {
+		if follower {
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			c.next.ServeHTTP(w, r)
+			return
+		}
+		if li := logInfoFrom(r.Context()); li != nil {
+			li.upstream = call.li.upstream
+		}
+		if call.aborted {
+			// As ReverseProxy would: the client must see the cut.
+			panic(http.ErrAbortHandler)
+		}
+		return
+	}
+
+	if li := logInfoFrom(r.Context()); li != nil {
+		li.upstream = call.li.upstream
+	}
+	if follower {
+		markSharedRender(r)
+	}
+	maps.Copy(w.Header(), call.resp.header)
+	w.Header().Set("Content-Length", strconv.Itoa(call.resp.body.Len()))
+	w.WriteHeader(call.resp.code)
+	w.Write(call.resp.body.Bytes())
+}
+
+func (c *Coalescer) run(key string, call *renderCall, r *http.Request, body []byte) {
+	// The starting client's request may be long gone by the time this
+	// finishes, so it works on a copy with its own context and log info.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), coalesceTimeout)
+	defer cancel()
+	ctx = context.WithValue(ctx, logInfoKey{}, &call.li)
+	up := r.Clone(ctx)
+	up.Body = io.NopCloser(bytes.NewReader(body))
+
+	defer func() {
+		// ReverseProxy panics with ErrAbortHandler when the upstream dies
+		// mid-body. Out here that would take the process down.
+		p := recover()
+		if p != nil && p != http.ErrAbortHandler {
+			slog.Error("coalesced render", "panic", p)
+		}
+		switch {
+		case call.resp.streamed:
+			call.aborted = p != nil
+		case call.resp.overflow:
+			// The leader left; followers fetch their own copies.
+		case p != nil || call.resp.truncated():
+			call.resp.reset()
+			jsonError(call.resp, http.StatusBadGateway, "upstream unavailable")
+		}
+		if call.resp.code == 0 {
+			call.resp.code = http.StatusOK
+		}
+		c.mu.Lock()
+		delete(c.inflight, key)
+		c.mu.Unlock()
+		close(call.done)
+	}()
+	c.next.ServeHTTP(call.resp, up)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+const coalesceBody = `{"width":640,"height":480,"kind":"png"}`
+
+// blockingBackend holds every render until release is closed, then
+// answers with status.
+func blockingBackend(hits *atomic.Int64, release chan struct{}, status int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		<-release
+		w.Header().Set("Content-Type", "image/png")
+		w.WriteHeader(status)
+		w.Write([]byte("PNG"))
+	})
+}
+
+// startRenders sends n identical renders through h and waits until all
+// but the first are queued behind it.
+func startRenders(t *testing.T, h http.Handler, n int, ctx context.Context) (*sync.WaitGroup, []*httptest.ResponseRecorder) {
+	t.Helper()
+	before := renderCoalesced.Value()
+	var wg sync.WaitGroup
+	recs := make([]*httptest.ResponseRecorder, n)
+	for i := range recs {
+		recs[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest("POST", "/generate/", strings.NewReader(coalesceBody))
+			if i == 0 {
+				req = req.WithContext(ctx)
+			}
+			h.ServeHTTP(recs[i], req)
+		}()
+		if i == 0 {
+			// Let the first one become the leader.
+			waitFor(t, func() bool {
+				h := h.(*Coalescer)
+				h.mu.Lock()
+				defer h.mu.Unlock()
+				return len(h.inflight) == 1
+			})
+		}
+	}
+	waitFor(t, func() bool { return renderCoalesced.Value()-before == int64(n-1) })
+	return &wg, recs
+}
+
+func TestCoalesce(t *testing.T) {
+	var hits atomic.Int64
+	release := make(chan struct{})
+	h := Coalesce(blockingBackend(&hits, release, http.StatusOK))
+
+	wg, recs := startRenders(t, h, 10, context.Background())
+	close(release)
+	wg.Wait()
+	for i, rec := range recs {
+		if rec.Code != 200 || rec.Body.String() != "PNG" || rec.Header().Get("Content-Type") != "image/png" {
+			t.Errorf("client %d: %d %q", i, rec.Code, rec.Body.String())
+		}
+	}
+	if n := hits.Load(); n != 1 {
+		t.Errorf("%d upstream renders, want 1", n)
+	}
+
+	// Once it's done, the next request renders again.
+	if rec := postGenerate(h, "/generate/", coalesceBody); rec.Code != 200 || hits.Load() != 2 {
+		t.Errorf("after completion: status %d, %d renders", rec.Code, hits.Load())
+	}
+}
+
+func TestCoalesce_LeaderDisconnects(t *testing.T) {
+	var hits atomic.Int64
+	release := make(chan struct{})
+	h := Coalesce(blockingBackend(&hits, release, http.StatusOK))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg, recs := startRenders(t, h, 3, ctx)
+	cancel()
+	close(release)
+	wg.Wait()
+	for i, rec := range recs[1:] {
+		if rec.Code != 200 || rec.Body.String() != "PNG" {
+			t.Errorf("follower %d: %d %q", i, rec.Code, rec.Body.String())
+		}
+	}
+	if n := hits.Load(); n != 1 {
+		t.Errorf("%d upstream renders, want 1", n)
+	}
+}
+
+func TestCoalesce_UpstreamError(t *testing.T) {
+	var hits atomic.Int64
+	release := make(chan struct{})
+	h := Coalesce(blockingBackend(&hits, release, http.StatusServiceUnavailable))
+
+	wg, recs := startRenders(t, h, 3, context.Background())
+	close(release)
+	wg.Wait()
+	for i, rec := range recs {
+		if rec.Code != 503 {
+			t.Errorf("client %d: status %d, want 503", i, rec.Code)
+		}
+	}
+}
+
+func TestCoalesce_UpstreamDiesMidBody(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1000")
+		w.Write([]byte("PNG"))
+		conn, _, _ := http.NewResponseController(w).Hijack()
+		conn.Close()
+	}))
+	defer backend.Close()
+	u, _ := url.Parse(backend.URL)
+	pool := newReverseProxy(u, ":9090")
+
+	rec := postGenerate(Coalesce(pool), "/generate/", coalesceBody)
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("status = %d, want 502", rec.Code)
+	}
+
+	// Behind a real server ReverseProxy panics instead.
+	front := httptest.NewServer(Coalesce(pool))
+	defer front.Close()
+	resp, err := http.Post(front.URL+"/generate/", "application/json", strings.NewReader(coalesceBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("status = %d, want 502", resp.StatusCode)
+	}
+}
+
+func TestCoalesce_LeaderGoneUpstreamDies(t *testing.T) {
+	die := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1000")
+		w.Write([]byte("PNG"))
+		http.NewResponseController(w).Flush()
+		<-die
+		conn, _, _ := http.NewResponseController(w).Hijack()
+		conn.Close()
+	}))
+	defer backend.Close()
+	u, _ := url.Parse(backend.URL)
+	h := Coalesce(newReverseProxy(u, ":9090"))
+
+	inflight := func(f func(*bufferedResponse) bool) func() bool {
+		return func() bool {
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			for _, call := range h.inflight {
+				call.resp.mu.Lock()
+				defer call.resp.mu.Unlock()
+				return f(call.resp)
+			}
+			return false
+		}
+	}
+
+	// The leader hangs up part way through the body, then the upstream
+	// dies; the follower gets a clean 502.
+	ctx, cancel := context.WithCancel(context.Background())
+	wg, recs := startRenders(t, h, 2, ctx)
+	waitFor(t, inflight(func(b *bufferedResponse) bool { return b.body.Len() == 3 }))
+	cancel()
+	waitFor(t, inflight(func(b *bufferedResponse) bool { return b.leader == nil }))
+	close(die)
+	wg.Wait()
+	if rec := recs[1]; rec.Code != http.StatusBadGateway || strings.Contains(rec.Body.String(), "PNG") {
+		t.Errorf("follower: %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestCoalesce_TooLargeToShare(t *testing.T) {
+	var hits atomic.Int64
+	release := make(chan struct{})
+	h := Coalesce(blockingBackend(&hits, release, http.StatusOK))
+	h.MaxBuffer = 2
+
+	// The leader gets the render as it streams; the others can't share
+	// it and render their own.
+	wg, recs := startRenders(t, h, 3, context.Background())
+	close(release)
+	wg.Wait()
+	for i, rec := range recs {
+		if rec.Code != 200 || rec.Body.String() != "PNG" || rec.Header().Get("Content-Type") != "image/png" {
+			t.Errorf("client %d: %d %q", i, rec.Code, rec.Body.String())
+		}
+	}
+	if n := hits.Load(); n != 3 {
+		t.Errorf("%d upstream renders, want 3", n)
+	}
+
+	// Same when the leader has gone by the time the body arrives.
+	hits.Store(0)
+	release = make(chan struct{})
+	h = Coalesce(blockingBackend(&hits, release, http.StatusOK))
+	h.MaxBuffer = 2
+	ctx, cancel := context.WithCancel(context.Background())
+	wg, recs = startRenders(t, h, 3, ctx)
+	cancel()
+	waitFor(t, func() bool {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		for _, call := range h.inflight {
+			call.resp.mu.Lock()
+			defer call.resp.mu.Unlock()
+			return call.resp.leader == nil
+		}
+		return false
+	})
+	close(release)
+	wg.Wait()
+	for i, rec := range recs[1:] {
+		if rec.Code != 200 || rec.Body.String() != "PNG" {
+			t.Errorf("follower %d: %d %q", i, rec.Code, rec.Body.String())
+		}
+	}
+	if recs[0].Body.Len() != 0 {
+		t.Errorf("departed leader was written to: %q", recs[0].Body.String())
+	}
+}
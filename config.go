@@ -1,27 +1,189 @@
 package main
 
 import (
+	"fmt"
 	"log/slog"
+	"net"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type Config struct {
-	ListenAddr    string
-	Image         string
-	ContainerPort int
-	JWTSecret     string
-	LogLevel      slog.Level
+	ListenAddr     string
+	PublicURL      string
+	Image          string
+	ContainerPort  int
+	Replicas       int
+	JWTSecret      string
+	JWTPrivateKey  string
+	KeyRotation    time.Duration
+	JWTIssuer      string
+	JWTAudience    string
+	AcceptIssuers  []string
+	AcceptAuds     []string
+	RequiredClaims []string
+	JWTLeeway      time.Duration
+	AdminToken     string
+	PresignSecret  string
+	DataDir        string
+	RefreshTTL     time.Duration
+	ClientsFile    string
+	OIDCIssuer     string
+	OIDCAudience   string
+	TLSCert        string
+	TLSKey         string
+	ClientCA       string
+	ClientCRL      string
+	ClientAuth     string
+	MTLSIdentities string
+	LogLevel       slog.Level
+
+	Upstreams      []string
+	LBStrategy     string
+	HealthInterval time.Duration
+	HealthPath     string
+	UpstreamFall   int
+	UpstreamRise   int
+	EjectFor       time.Duration
+
+	AutoscaleMin      int
+	AutoscaleMax      int
+	AutoscaleEvery    time.Duration
+	TargetInflight    int
+	TargetLatency     time.Duration
+	ScaleUpCooldown   time.Duration
+	ScaleDownCooldown time.Duration
+	DrainTimeout      time.Duration
+	OnDemandIdle      time.Duration
+
+	RenderCacheMB     int
+	RenderCacheDir    string
+	RenderCacheDiskMB int
+
+	RenderMaxWidth      int
+	RenderMaxHeight     int
+	RenderMaxIterations int
+	RenderKinds         []string
+
+	LockoutThreshold int
+	LockoutWindow    time.Duration
+	LockoutBase      time.Duration
+	LockoutMax       time.Duration
+	LockoutAllow     []string
+
+	RateLimit          string
+	RateLimitRoles     []string
+	RateLimitPresigned string
+
+	QuotaDaily   int
+	QuotaMonthly int
 }
 
 func loadConfig() Config {
 	return Config{
-		ListenAddr:    env("LISTEN_ADDR", ":9090"),
-		Image:         env("MANDELBROT_IMAGE", "lechgu/mandelbrot"),
-		ContainerPort: envInt("CONTAINER_PORT", 8080),
-		JWTSecret:     env("JWT_SECRET", "mandelbrot-dev-secret-do-not-use-in-prod"),
-		LogLevel:      parseLogLevel(env("LOG_LEVEL", "info")),
+		ListenAddr:     env("LISTEN_ADDR", ":9090"),
+		PublicURL:      env("PUBLIC_URL", ""),
+		Image:          env("MANDELBROT_IMAGE", "lechgu/mandelbrot"),
+		ContainerPort:  envInt("CONTAINER_PORT", 8080),
+		Replicas:       envInt("REPLICAS", 1),
+		JWTSecret:      env("JWT_SECRET", "mandelbrot-dev-secret-do-not-use-in-prod"),
+		JWTPrivateKey:  env("JWT_PRIVATE_KEY", ""),
+		KeyRotation:    envDuration("JWT_ROTATE_EVERY", 0),
+		JWTIssuer:      env("JWT_ISSUER", defaultIssuer),
+		JWTAudience:    env("JWT_AUDIENCE", ""),
+		AcceptIssuers:  envList("JWT_ACCEPT_ISSUERS", nil),
+		AcceptAuds:     envList("JWT_ACCEPT_AUDIENCES", nil),
+		RequiredClaims: envList("JWT_REQUIRED_CLAIMS", []string{"exp", "iat", "jti"}),
+		JWTLeeway:      envDuration("JWT_LEEWAY", 30*time.Second),
+		AdminToken:     env("ADMIN_TOKEN", ""),
+		PresignSecret:  env("PRESIGN_SECRET", ""),
+		DataDir:        env("DATA_DIR", "data"),
+		RefreshTTL:     envDuration("REFRESH_TTL", 30*24*time.Hour),
+		ClientsFile:    env("CLIENTS_FILE", ""),
+		OIDCIssuer:     env("OIDC_ISSUER", ""),
+		OIDCAudience:   env("OIDC_AUDIENCE", ""),
+		TLSCert:        env("TLS_CERT", ""),
+		TLSKey:         env("TLS_KEY", ""),
+		ClientCA:       env("TLS_CLIENT_CA", ""),
+		ClientCRL:      env("TLS_CLIENT_CRL", ""),
+		ClientAuth:     env("TLS_CLIENT_AUTH", "optional"),
+		MTLSIdentities: env("MTLS_IDENTITIES", ""),
+		LogLevel:       parseLogLevel(env("LOG_LEVEL", "info")),
+
+		Upstreams:      envList("UPSTREAMS", nil),
+		LBStrategy:     env("LB_STRATEGY", RoundRobin),
+		HealthInterval: envDuration("HEALTH_CHECK_INTERVAL", 5*time.Second),
+		HealthPath:     env("HEALTH_CHECK_PATH", "/"),
+		UpstreamFall:   envInt("UPSTREAM_FALL", 3),
+		UpstreamRise:   envInt("UPSTREAM_RISE", 2),
+		EjectFor:       envDuration("UPSTREAM_EJECT_FOR", 30*time.Second),
+
+		AutoscaleMin:      envInt("AUTOSCALE_MIN", envInt("REPLICAS", 1)),
+		AutoscaleMax:      envInt("AUTOSCALE_MAX", 0),
+		AutoscaleEvery:    envDuration("AUTOSCALE_INTERVAL", 5*time.Second),
+		TargetInflight:    max(envInt("AUTOSCALE_TARGET_INFLIGHT", 4), 1),
+		TargetLatency:     envDuration("AUTOSCALE_TARGET_LATENCY", 0),
+		ScaleUpCooldown:   envDuration("AUTOSCALE_UP_COOLDOWN", 30*time.Second),
+		ScaleDownCooldown: envDuration("AUTOSCALE_DOWN_COOLDOWN", 5*time.Minute),
+		DrainTimeout:      envDuration("DRAIN_TIMEOUT", time.Minute),
+		OnDemandIdle:      envDuration("ON_DEMAND_IDLE", 0),
+
+		RenderCacheMB:     envInt("RENDER_CACHE_MB", 256),
+		RenderCacheDir:    env("RENDER_CACHE_DIR", ""),
+		RenderCacheDiskMB: envInt("RENDER_CACHE_DISK_MB", 1024),
+
+		RenderMaxWidth:      envInt("RENDER_MAX_WIDTH", 4096),
+		RenderMaxHeight:     envInt("RENDER_MAX_HEIGHT", 4096),
+		RenderMaxIterations: envInt("RENDER_MAX_ITERATIONS", 10000),
+		RenderKinds:         envList("RENDER_KINDS", []string{"png", "jpeg"}),
+
+		LockoutThreshold: envInt("LOCKOUT_THRESHOLD", 10),
+		LockoutWindow:    envDuration("LOCKOUT_WINDOW", 5*time.Minute),
+		LockoutBase:      envDuration("LOCKOUT_BASE", time.Minute),
+		LockoutMax:       envDuration("LOCKOUT_MAX", time.Hour),
+		LockoutAllow:     envList("LOCKOUT_ALLOW", nil),
+
+		RateLimit:          env("RATE_LIMIT", "120/m"),
+		RateLimitRoles:     envList("RATE_LIMIT_ROLES", nil),
+		RateLimitPresigned: env("RATE_LIMIT_PRESIGNED", "1200/m"),
+
+		QuotaDaily:   envInt("QUOTA_DAILY", 0),
+		QuotaMonthly: envInt("QUOTA_MONTHLY", 0),
+	}
+}
+
+// publicOrigin is where clients reach the proxy: PUBLIC_URL if set,
+// otherwise worked out from LISTEN_ADDR with an empty or wildcard host
+// standing for localhost.
+func (c Config) publicOrigin() (string, error) {
+	if c.PublicURL != "" {
+		u, err := url.Parse(c.PublicURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return "", fmt.Errorf("bad PUBLIC_URL %q, want e.g. https://mandelbrot.example.com", c.PublicURL)
+		}
+		return strings.TrimSuffix(c.PublicURL, "/"), nil
+	}
+	host, port, err := net.SplitHostPort(c.ListenAddr)
+	if err != nil {
+		return "", fmt.Errorf("bad LISTEN_ADDR %q: %w", c.ListenAddr, err)
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "localhost"
 	}
+	u := url.URL{Scheme: "http", Host: net.JoinHostPort(host, port)}
+	if c.TLSCert != "" {
+		u.Scheme = "https"
+	}
+	if u.Scheme == "http" && port == "80" || u.Scheme == "https" && port == "443" {
+		u.Host = host
+		if strings.Contains(host, ":") {
+			u.Host = "[" + host + "]"
+		}
+	}
+	return u.String(), nil
 }
 
 func env(key, fallback string) string {
@@ -40,6 +202,30 @@ func envInt(key string, fallback int) int {
 	return fallback
 }
 
+func envDuration(key string, fallback time.Duration) time.Duration {
+	if v := os.Getenv(key); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
+		}
+	}
+	return fallback
+}
+
+// envList reads a comma-separated list, dropping empty entries.
+func envList(key string, fallback []string) []string {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	var out []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
 func parseLogLevel(s string) slog.Level {
 	switch s {
 	case "debug":
@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestPublicOrigin(t *testing.T) {
+	cases := []struct {
+		cfg  Config
+		want string
+		ok   bool
+	}{
+		{Config{ListenAddr: ":9090"}, "http://localhost:9090", true},
+		{Config{ListenAddr: "0.0.0.0:9090"}, "http://localhost:9090", true},
+		{Config{ListenAddr: "[::]:9090"}, "http://localhost:9090", true},
+		{Config{ListenAddr: "proxy.internal:8080"}, "http://proxy.internal:8080", true},
+		{Config{ListenAddr: "10.0.0.5:443", TLSCert: "c.pem"}, "https://10.0.0.5", true},
+		{Config{ListenAddr: "[::1]:443", TLSCert: "c.pem"}, "https://[::1]", true},
+		{Config{ListenAddr: ":9090", PublicURL: "https://mandelbrot.example.com/"}, "https://mandelbrot.example.com", true},
+		{Config{ListenAddr: ":9090", PublicURL: "mandelbrot.example.com"}, "", false},
+		{Config{ListenAddr: "9090"}, "", false},
+	}
+	for _, tc := range cases {
+		got, err := tc.cfg.publicOrigin()
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Errorf("%+v: got %q, %v; want %q", tc.cfg, got, err, tc.want)
+		}
+	}
+}
@@ -2,10 +2,15 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/docker/docker/api/types/container"
@@ -14,10 +19,33 @@ import (
 	"github.com/docker/go-connections/nat"
 )
 
+// Containers we start carry this label and a name with this prefix.
+const containerPrefix = "mandelbrot-auth-proxy"
+
+// Replica is one running mandelbrot container.
+type Replica struct {
+	ID   string
+	Name string
+	Port int // on 127.0.0.1
+}
+
+func (r *Replica) URL() *url.URL {
+	return &url.URL{Scheme: "http", Host: "127.0.0.1:" + strconv.Itoa(r.Port)}
+}
+
+// DockerManager runs a set of identical mandelbrot containers.
 type DockerManager struct {
-	cli      *client.Client
-	img      string
+	cli *client.Client
+	img string
+	// hostPort pins a lone replica to a known port; with more than one,
+	// or when it is 0, Docker picks free ports.
 	hostPort int
+
+	mu       sync.Mutex
+	replicas map[string]*Replica // by container id
+
+	pullMu sync.Mutex
+	pulled bool
 }
 
 func NewDockerManager(img string, hostPort int) (*DockerManager, error) {
@@ -25,46 +53,155 @@ func NewDockerManager(img string, hostPort int) (*DockerManager, error) {
 	if err != nil {
 		return nil, fmt.Errorf("docker client: %w", err)
 	}
-	return &DockerManager{cli: cli, img: img, hostPort: hostPort}, nil
+	return &DockerManager{cli: cli, img: img, hostPort: hostPort, replicas: map[string]*Replica{}}, nil
 }
 
-func (dm *DockerManager) Start(ctx context.Context) (string, error) {
+// pull fetches the image the first time it's called.
+func (dm *DockerManager) pull(ctx context.Context) error {
+	dm.pullMu.Lock()
+	defer dm.pullMu.Unlock()
+	if dm.pulled {
+		return nil
+	}
 	slog.Info("pulling image", "image", dm.img)
 	rc, err := dm.cli.ImagePull(ctx, dm.img, image.PullOptions{})
 	if err != nil {
-		return "", fmt.Errorf("pull %s: %w", dm.img, err)
+		return fmt.Errorf("pull %s: %w", dm.img, err)
 	}
 	// Pull isn't done until the reader is drained.
 	io.Copy(io.Discard, rc)
 	rc.Close()
+	dm.pulled = true
+	return nil
+}
+
+// Start pulls the image and starts a single container.
+func (dm *DockerManager) Start(ctx context.Context) (string, error) {
+	if err := dm.pull(ctx); err != nil {
+		return "", err
+	}
+	r, err := dm.startReplica(ctx, dm.hostPort)
+	if err != nil {
+		return "", err
+	}
+	return r.ID, nil
+}
+
+// StartReplicas pulls the image and starts n containers. If any fail to
+// start, the ones that did are removed again.
+func (dm *DockerManager) StartReplicas(ctx context.Context, n int) ([]*Replica, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	if err := dm.pull(ctx); err != nil {
+		return nil, err
+	}
+	port := dm.hostPort
+	if n > 1 {
+		port = 0
+	}
+
+	var started []*Replica
+	for range n {
+		r, err := dm.startReplica(ctx, port)
+		if err != nil {
+			for _, s := range started {
+				dm.Stop(context.WithoutCancel(ctx), s.ID)
+			}
+			return nil, err
+		}
+		started = append(started, r)
+	}
+	return started, nil
+}
+
+func (dm *DockerManager) startReplica(ctx context.Context, hostPort int) (*Replica, error) {
+	name := containerPrefix + "-" + randomID(4)
+	hp := ""
+	if hostPort > 0 {
+		hp = strconv.Itoa(hostPort)
+	}
 
 	p := nat.Port("80/tcp")
 	resp, err := dm.cli.ContainerCreate(ctx,
 		&container.Config{
 			Image:        dm.img,
 			ExposedPorts: nat.PortSet{p: {}},
+			Labels:       map[string]string{containerPrefix: "1"},
 		},
 		&container.HostConfig{
 			PortBindings: nat.PortMap{
-				p: {{HostIP: "127.0.0.1", HostPort: fmt.Sprintf("%d", dm.hostPort)}},
+				p: {{HostIP: "127.0.0.1", HostPort: hp}},
 			},
 		},
-		nil, nil, "mandelbrot-auth-proxy",
+		nil, nil, name,
 	)
 	if err != nil {
-		return "", fmt.Errorf("create container: %w", err)
+		return nil, fmt.Errorf("create container: %w", err)
 	}
 
 	if err := dm.cli.ContainerStart(ctx, resp.ID, container.StartOptions{}); err != nil {
-		return "", fmt.Errorf("start container: %w", err)
+		dm.cli.ContainerRemove(ctx, resp.ID, container.RemoveOptions{Force: true})
+		return nil, fmt.Errorf("start container: %w", err)
+	}
+
+	// With a dynamic binding the port is only known once it's running.
+	info, err := dm.cli.ContainerInspect(ctx, resp.ID)
+	if err == nil && info.NetworkSettings != nil && len(info.NetworkSettings.Ports[p]) > 0 {
+		hostPort, err = strconv.Atoi(info.NetworkSettings.Ports[p][0].HostPort)
+	} else if err == nil {
+		err = errors.New("no host port bound")
+	}
+	if err != nil {
+		dm.cli.ContainerRemove(ctx, resp.ID, container.RemoveOptions{Force: true})
+		return nil, fmt.Errorf("inspect container: %w", err)
 	}
-	return resp.ID, nil
+
+	r := &Replica{ID: resp.ID, Name: name, Port: hostPort}
+	dm.mu.Lock()
+	dm.replicas[r.ID] = r
+	dm.mu.Unlock()
+	slog.Info("container started", "id", r.ID[:12], "name", name, "port", hostPort)
+	return r, nil
+}
+
+// StartReplica adds one container on a free port and waits for it to
+// answer.
+func (dm *DockerManager) StartReplica(ctx context.Context) (*Replica, error) {
+	if err := dm.pull(ctx); err != nil {
+		return nil, err
+	}
+	r, err := dm.startReplica(ctx, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := waitReady(ctx, r.Port, 30*time.Second); err != nil {
+		dm.Stop(context.WithoutCancel(ctx), r.ID)
+		return nil, fmt.Errorf("%s: %w", r.Name, err)
+	}
+	return r, nil
+}
+
+// Replicas lists the running containers by name.
+func (dm *DockerManager) Replicas() []*Replica {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	out := make([]*Replica, 0, len(dm.replicas))
+	for _, r := range dm.replicas {
+		out = append(out, r)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
 }
 
 func (dm *DockerManager) Stop(ctx context.Context, id string) error {
 	timeout := 10
 	dm.cli.ContainerStop(ctx, id, container.StopOptions{Timeout: &timeout})
 
+	dm.mu.Lock()
+	delete(dm.replicas, id)
+	dm.mu.Unlock()
+
 	if err := dm.cli.ContainerRemove(ctx, id, container.RemoveOptions{Force: true}); err != nil {
 		return fmt.Errorf("remove container: %w", err)
 	}
@@ -72,12 +209,46 @@ func (dm *DockerManager) Stop(ctx context.Context, id string) error {
 	return nil
 }
 
+// StopAll removes every replica, in parallel.
+func (dm *DockerManager) StopAll(ctx context.Context) error {
+	replicas := dm.Replicas()
+	errs := make([]error, len(replicas))
+	var wg sync.WaitGroup
+	for i, r := range replicas {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = dm.Stop(ctx, r.ID)
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// WaitReady waits until every replica answers on its port.
 func (dm *DockerManager) WaitReady(ctx context.Context, timeout time.Duration) error {
+	replicas := dm.Replicas()
+	errs := make([]error, len(replicas))
+	var wg sync.WaitGroup
+	for i, r := range replicas {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := waitReady(ctx, r.Port, timeout); err != nil {
+				errs[i] = fmt.Errorf("%s: %w", r.Name, err)
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+func waitReady(ctx context.Context, port int, timeout time.Duration) error {
 	deadline := time.After(timeout)
 	tick := time.NewTicker(500 * time.Millisecond)
 	defer tick.Stop()
 
-	addr := fmt.Sprintf("http://127.0.0.1:%d/", dm.hostPort)
+	addr := fmt.Sprintf("http://127.0.0.1:%d/", port)
 	hc := &http.Client{Timeout: 2 * time.Second}
 
 	for {
@@ -64,8 +64,49 @@ func TestDockerLifecycle_Live(t *testing.T) {
 	}
 }
 
+func TestDockerReplicas_Live(t *testing.T) {
+	if os.Getenv("TEST_DOCKER") == "" && !dockerAvailable() {
+		t.Skip("no docker daemon; set TEST_DOCKER=1 to force")
+	}
+
+	dm, err := NewDockerManager("lechgu/mandelbrot", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	replicas, err := dm.StartReplicas(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dm.StopAll(context.Background())
+
+	if len(replicas) != 2 || replicas[0].Port == replicas[1].Port || replicas[0].Name == replicas[1].Name {
+		t.Fatalf("replicas = %+v, %+v", replicas[0], replicas[1])
+	}
+	if err := dm.WaitReady(ctx, 30*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range replicas {
+		resp, err := http.Get(r.URL().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	if err := dm.StopAll(ctx); err != nil {
+		t.Error(err)
+	}
+	if n := len(dm.Replicas()); n != 0 {
+		t.Errorf("%d replicas left after StopAll", n)
+	}
+}
+
 func TestWaitReady_CancelledContext(t *testing.T) {
-	dm := &DockerManager{hostPort: 19999} // port nobody is listening on
+	// port nobody is listening on
+	dm := &DockerManager{replicas: map[string]*Replica{"x": {ID: "x", Name: "x", Port: 19999}}}
 	ctx, cancel := context.WithCancel(context.Background())
 	cancel()
 
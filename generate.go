@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// Render bodies are a handful of numbers; anything bigger is not one.
+const maxGenerateBody = 64 << 10
+
+// GenerateRequest is the JSON body the mandelbrot container expects on
+// POST /generate/.
+type GenerateRequest struct {
+	Width      int64   `json:"width"`
+	Height     int64   `json:"height"`
+	Iterations int64   `json:"iterations"`
+	ReMin      float64 `json:"re_min"`
+	ReMax      float64 `json:"re_max"`
+	ImMin      float64 `json:"im_min"`
+	ImMax      float64 `json:"im_max"`
+	Kind       string  `json:"kind"`
+}
+
+// fullView is the classic whole-set framing, which counts as zoom 1.
+var fullView = Region{ReMin: -2, ReMax: 1, ImMin: -1, ImMax: 1}
+
+func (g *GenerateRequest) Bounds() Region {
+	return Region{ReMin: g.ReMin, ReMax: g.ReMax, ImMin: g.ImMin, ImMax: g.ImMax}
+}
+
+// Zoom is how much narrower the view is than fullView, on whichever axis
+// is narrower. Only meaningful for valid bounds.
+func (g *GenerateRequest) Zoom() float64 {
+	return max((fullView.ReMax-fullView.ReMin)/(g.ReMax-g.ReMin),
+		(fullView.ImMax-fullView.ImMin)/(g.ImMax-g.ImMin))
+}
+
+type sharedRenderKey struct{}
+
+// withSharedRender lets a handler find out whether the render it passes
+// on was answered from work done for someone else, a cache hit or a
+// coalesced copy, rather than rendered for this request.
+func withSharedRender(r *http.Request) (*http.Request, *atomic.Bool) {
+	shared := new(atomic.Bool)
+	return r.WithContext(context.WithValue(r.Context(), sharedRenderKey{}, shared)), shared
+}
+
+// markSharedRender says r's render wasn't its own.
+func markSharedRender(r *http.Request) {
+	if shared, ok := r.Context().Value(sharedRenderKey{}).(*atomic.Bool); ok {
+		shared.Store(true)
+	}
+}
+
+func isGeneratePath(p string) bool {
+	return strings.TrimSuffix(p, "/") == "/generate"
+}
+
+// readGenerateBody reads the body of a /generate call and puts the raw
+// bytes back so the request can still be proxied.
+func readGenerateBody(r *http.Request) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxGenerateBody+1))
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxGenerateBody {
+		return nil, errors.New("request body too large")
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	return body, nil
+}
+
+// readGenerateRequest decodes the body of a /generate call, leaving it in
+// place for the proxy.
+func readGenerateRequest(r *http.Request) (*GenerateRequest, error) {
+	body, err := readGenerateBody(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var req GenerateRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, errors.New("invalid JSON")
+	}
+	return &req, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Entitlements describe what a caller may render. They travel as token
+// claims and end up on the request's Identity. Zero limits mean no limit.
+type Entitlements struct {
+	Roles []string `json:"roles,omitempty"`
+	// Space separated, as in RFC 8693.
+	Scope         string `json:"scope,omitempty"`
+	MaxPixels     int64  `json:"max_pixels,omitempty"`
+	MaxIterations int64  `json:"max_iterations,omitempty"`
+	// Region, when set, is the part of the plane that may be rendered.
+	Region *Region `json:"region,omitempty"`
+	// MaxZoom caps magnification relative to the full view (see Zoom).
+	MaxZoom float64 `json:"max_zoom,omitempty"`
+}
+
+// Region is a box on the complex plane, in the same terms as the bounds
+// of a generate request.
+type Region struct {
+	ReMin float64 `json:"re_min"`
+	ReMax float64 `json:"re_max"`
+	ImMin float64 `json:"im_min"`
+	ImMax float64 `json:"im_max"`
+}
+
+func (g Region) valid() bool {
+	return g.ReMin < g.ReMax && g.ImMin < g.ImMax
+}
+
+func (g Region) Contains(o Region) bool {
+	return o.ReMin >= g.ReMin && o.ReMax <= g.ReMax && o.ImMin >= g.ImMin && o.ImMax <= g.ImMax
+}
+
+func (e *Entitlements) HasRole(role string) bool {
+	return slices.Contains(e.Roles, role)
+}
+
+func (e *Entitlements) HasScope(scope string) bool {
+	return slices.Contains(strings.Fields(e.Scope), scope)
+}
+
+// Claims is what our tokens carry: the registered claims plus
+// entitlements. Tokens from an OIDC provider parse into the same shape,
+// so an IdP can grant roles and scopes too.
+type Claims struct {
+	jwt.RegisteredClaims
+	Entitlements
+}
+
+// Identity is the authenticated caller, attached to the request context
+// by Middleware for everything downstream.
+type Identity struct {
+	Subject string
+	// How the caller authenticated: "jwt", "oidc", "apikey", "mtls" or
+	// "presigned".
+	Method string
+	// TokenID is the jti of the bearer token, if that's how the caller
+	// authenticated.
+	TokenID string
+	// KeyID is the API key's id, if that's how the caller authenticated.
+	KeyID string
+	// Expires is when the credential stops working; zero if it doesn't.
+	Expires time.Time
+	Entitlements
+}
+
+type identityKey struct{}
+
+func withIdentity(r *http.Request, id *Identity) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), identityKey{}, id))
+}
+
+// authenticated attaches id to the request and reports it to the access
+// log, whichever way the caller authenticated.
+func authenticated(r *http.Request, id *Identity) *http.Request {
+	if li := logInfoFrom(r.Context()); li != nil {
+		li.subject, li.auth = id.Subject, id.Method
+	}
+	return withIdentity(r, id)
+}
+
+// identityFrom returns the caller's identity, or nil on routes that
+// don't go through Middleware.
+func identityFrom(ctx context.Context) *Identity {
+	id, _ := ctx.Value(identityKey{}).(*Identity)
+	return id
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+)
+
+// introspection is an RFC 7662 response. "revoked" is our own extension
+// so callers can tell a killed token from an expired or forged one.
+type introspection struct {
+	Active    bool     `json:"active"`
+	Revoked   bool     `json:"revoked,omitempty"`
+	Subject   string   `json:"sub,omitempty"`
+	Issuer    string   `json:"iss,omitempty"`
+	Audience  []string `json:"aud,omitempty"`
+	Expires   int64    `json:"exp,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	JTI       string   `json:"jti,omitempty"`
+	Scope     string   `json:"scope,omitempty"`
+	Roles     []string `json:"roles,omitempty"`
+	TokenType string   `json:"token_type,omitempty"`
+}
+
+// POST /introspect — RFC 7662 token introspection for other services.
+// Callers authenticate with client credentials like POST /token; the
+// token goes in a form body.
+func (j *JWTAuth) HandleIntrospect(w http.ResponseWriter, r *http.Request) {
+	if j.Clients == nil {
+		jsonError(w, http.StatusNotImplemented, "introspection needs CLIENTS_FILE")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		jsonError(w, http.StatusBadRequest, "invalid form body")
+		return
+	}
+	client, ok := j.authenticateClient(w, r, "introspect", r.PostForm.Get("client_id"), r.PostForm.Get("client_secret"))
+	if !ok {
+		return
+	}
+	raw := r.PostForm.Get("token")
+	if raw == "" {
+		jsonError(w, http.StatusBadRequest, "token is required")
+		return
+	}
+
+	// Responses describe live credentials; nobody should cache them.
+	w.Header().Set("Cache-Control", "no-store")
+
+	claims, _, err := j.verifyBearer(raw)
+	if err != nil {
+		slog.Debug("introspect inactive", "client", client.ID, "err", err)
+		writeJSON(w, http.StatusOK, introspection{Active: false, Revoked: errors.Is(err, ErrRevoked)})
+		return
+	}
+
+	resp := introspection{
+		Active:    true,
+		Subject:   claims.Subject,
+		Issuer:    claims.Issuer,
+		Audience:  claims.Audience,
+		JTI:       claims.ID,
+		Scope:     claims.Scope,
+		Roles:     claims.Roles,
+		TokenType: "Bearer",
+	}
+	if claims.ExpiresAt != nil {
+		resp.Expires = claims.ExpiresAt.Unix()
+	}
+	if claims.IssuedAt != nil {
+		resp.IssuedAt = claims.IssuedAt.Unix()
+	}
+	if claims.NotBefore != nil {
+		resp.NotBefore = claims.NotBefore.Unix()
+	}
+	slog.Debug("introspect active", "client", client.ID, "sub", claims.Subject)
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func introspect(auth *JWTAuth, user, pass, token string) (int, map[string]any) {
+	req := httptest.NewRequest("POST", "/introspect", strings.NewReader(url.Values{"token": {token}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if user != "" {
+		req.SetBasicAuth(user, pass)
+	}
+	rec := httptest.NewRecorder()
+	auth.HandleIntrospect(rec, req)
+	var resp map[string]any
+	json.NewDecoder(rec.Body).Decode(&resp)
+	return rec.Code, resp
+}
+
+func TestHandleIntrospect(t *testing.T) {
+	auth := newClientAuth(t)
+	dl, _ := OpenDenyList("")
+	auth.Revocations = dl
+
+	active, _, _ := auth.issue("alice", Entitlements{Scope: "generate"}, time.Hour)
+	revoked, _ := auth.IssueToken("bob", time.Hour)
+	dl.RevokeSubject("bob")
+	expired, _ := auth.IssueToken("carol", -time.Hour)
+
+	t.Run("active", func(t *testing.T) {
+		code, resp := introspect(auth, "renderer", "s3cret", active)
+		if code != 200 || resp["active"] != true {
+			t.Fatalf("status = %d, resp = %v", code, resp)
+		}
+		if resp["sub"] != "alice" || resp["scope"] != "generate" || resp["iss"] != "mandelbrot-auth-proxy" {
+			t.Errorf("resp = %v", resp)
+		}
+		if resp["exp"] == nil || resp["iat"] == nil || resp["jti"] == nil {
+			t.Errorf("missing timestamps or jti: %v", resp)
+		}
+	})
+
+	t.Run("revoked", func(t *testing.T) {
+		_, resp := introspect(auth, "renderer", "s3cret", revoked)
+		if resp["active"] != false || resp["revoked"] != true {
+			t.Errorf("resp = %v", resp)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		_, resp := introspect(auth, "renderer", "s3cret", expired)
+		if resp["active"] != false || resp["sub"] != nil {
+			t.Errorf("resp = %v", resp)
+		}
+	})
+
+	t.Run("bad client", func(t *testing.T) {
+		if code, _ := introspect(auth, "renderer", "wrong", active); code != 401 {
+			t.Errorf("status = %d, want 401", code)
+		}
+		if code, _ := introspect(auth, "", "", active); code != 401 {
+			t.Errorf("status = %d, want 401", code)
+		}
+	})
+
+	t.Run("no registry", func(t *testing.T) {
+		if code, _ := introspect(NewJWTAuth(testSecret), "x", "y", active); code != 501 {
+			t.Errorf("status = %d, want 501", code)
+		}
+	})
+}
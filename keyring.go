@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// jwksMaxAge is how long verifiers may cache our JWKS. A new key is
+// published this long before anything is signed with it.
+const jwksMaxAge = 5 * time.Minute
+
+// Keyring holds the key JWTAuth currently signs with plus any older keys
+// that are still accepted for verification. A replaced key keeps
+// verifying for the grace period so tokens already handed out survive a
+// rotation; after that it is dropped. A rotated-in key is published for
+// lead before it starts signing, so verifiers that cached the JWKS see it
+// first.
+//
+// With Persist the keys are saved to disk and survive restarts; without
+// it they live in memory only.
+type Keyring struct {
+	mu      sync.RWMutex
+	current *signingKey
+	next    *signingKey // published, signing from nextAt
+	nextAt  time.Time
+	retired map[string]retiredKey
+	grace   time.Duration
+	lead    time.Duration
+	path    string
+	base    string // kid of the configured key the saved ring grew from
+}
+
+type retiredKey struct {
+	key      *signingKey
+	retireAt time.Time
+}
+
+func NewKeyring(k *signingKey, grace time.Duration) *Keyring {
+	return &Keyring{current: k, retired: map[string]retiredKey{}, grace: grace, lead: jwksMaxAge, base: k.kid}
+}
+
+// Current returns the signing key, switching to the next one if it is
+// due.
+func (kr *Keyring) Current() *signingKey {
+	kr.mu.RLock()
+	k, due := kr.current, kr.next != nil && !time.Now().Before(kr.nextAt)
+	kr.mu.RUnlock()
+	if !due {
+		return k
+	}
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	kr.promoteLocked(time.Now())
+	return kr.current
+}
+
+// Lookup finds a verification key by kid. An empty kid means the token
+// predates kid headers, so we try the current key.
+func (kr *Keyring) Lookup(kid string) (*signingKey, bool) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	if kid == "" || kid == kr.current.kid {
+		return kr.current, true
+	}
+	if kr.next != nil && kid == kr.next.kid {
+		return kr.next, true
+	}
+	rk, ok := kr.retired[kid]
+	if !ok || time.Now().After(rk.retireAt) {
+		return nil, false
+	}
+	return rk.key, true
+}
+
+// Keys returns every key that currently verifies, current first, plus
+// the next one if a rotation is pending.
+func (kr *Keyring) Keys() []*signingKey {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	now := time.Now()
+	keys := []*signingKey{kr.current}
+	if kr.next != nil {
+		keys = append(keys, kr.next)
+	}
+	for _, rk := range kr.retired {
+		if now.Before(rk.retireAt) {
+			keys = append(keys, rk.key)
+		}
+	}
+	return keys
+}
+
+// Add publishes k and makes it the signing key once lead has passed. The
+// previous one keeps verifying until grace after that.
+func (kr *Keyring) Add(k *signingKey) time.Time {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	now := time.Now()
+	kr.promoteLocked(now)
+	if kr.next != nil {
+		// Superseded before it signed anything.
+		kr.retired[kr.next.kid] = retiredKey{key: kr.next, retireAt: now.Add(kr.lead)}
+	}
+	kr.next, kr.nextAt = k, now.Add(kr.lead)
+	kr.promoteLocked(now)
+	kr.saveLocked()
+	return kr.nextAt
+}
+
+// promoteLocked swaps in the next key if it is due and drops retired keys
+// past their grace period.
+func (kr *Keyring) promoteLocked(now time.Time) {
+	changed := false
+	if kr.next != nil && !now.Before(kr.nextAt) {
+		kr.retired[kr.current.kid] = retiredKey{key: kr.current, retireAt: now.Add(kr.grace)}
+		kr.current, kr.next = kr.next, nil
+		delete(kr.retired, kr.current.kid)
+		slog.Info("signing with new key", "kid", kr.current.kid)
+		changed = true
+	}
+	for kid, rk := range kr.retired {
+		if now.After(rk.retireAt) {
+			delete(kr.retired, kid)
+			changed = true
+		}
+	}
+	if changed {
+		kr.saveLocked()
+	}
+}
+
+// Rotate generates a fresh key of the same kind as the current one and
+// publishes it. It returns the key and when it starts signing.
+func (kr *Keyring) Rotate() (*signingKey, time.Time, error) {
+	k, err := generateLike(kr.Current())
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	at := kr.Add(k)
+	slog.Info("rotated signing key", "kid", k.kid, "alg", k.method.Alg(), "signing_from", at)
+	return k, at, nil
+}
+
+// storedKey is a key as saved by Persist: HMAC secrets raw, private keys
+// as PKCS#8.
+type storedKey struct {
+	Secret []byte    `json:"secret,omitempty"`
+	PKCS8  []byte    `json:"pkcs8,omitempty"`
+	At     time.Time `json:"at,omitzero"` // next: signs from; retired: verifies until
+}
+
+type keyringFile struct {
+	Base    string      `json:"base"`
+	Current storedKey   `json:"current"`
+	Next    *storedKey  `json:"next,omitempty"`
+	Retired []storedKey `json:"retired,omitempty"`
+}
+
+func storeKey(k *signingKey, at time.Time) (storedKey, error) {
+	if secret, ok := k.sign.([]byte); ok {
+		return storedKey{Secret: secret, At: at}, nil
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(k.sign)
+	if err != nil {
+		return storedKey{}, err
+	}
+	return storedKey{PKCS8: der, At: at}, nil
+}
+
+func (s storedKey) load() (*signingKey, error) {
+	if s.Secret != nil {
+		return hmacKey(s.Secret), nil
+	}
+	priv, err := x509.ParsePKCS8PrivateKey(s.PKCS8)
+	if err != nil {
+		return nil, err
+	}
+	return newSigningKey(priv)
+}
+
+// Persist loads the keys saved at path and saves every change there from
+// now on. If the configured key has changed since they were saved, it
+// takes over signing and the saved keys are kept only for verification.
+func (kr *Keyring) Persist(path string) error {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	kr.path = path
+
+	var f keyringFile
+	if err := readJSONFile(path, &f); err != nil {
+		return err
+	}
+	if f.Base == "" {
+		kr.saveLocked()
+		return nil
+	}
+	cur, err := f.Current.load()
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	now := time.Now()
+	for _, s := range f.Retired {
+		k, err := s.load()
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		kr.retired[k.kid] = retiredKey{key: k, retireAt: s.At}
+	}
+	var next *signingKey
+	if f.Next != nil {
+		if next, err = f.Next.load(); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	if f.Base == kr.base {
+		kr.current = cur
+		kr.next, kr.nextAt = next, time.Time{}
+		if next != nil {
+			kr.nextAt = f.Next.At
+		}
+	} else {
+		slog.Warn("configured signing key changed, saved keys only verify now", "path", path)
+		for _, k := range []*signingKey{cur, next} {
+			if k != nil && k.kid != kr.current.kid {
+				kr.retired[k.kid] = retiredKey{key: k, retireAt: now.Add(kr.grace)}
+			}
+		}
+	}
+	delete(kr.retired, kr.current.kid)
+	kr.promoteLocked(now)
+	kr.saveLocked()
+	return nil
+}
+
+func (kr *Keyring) saveLocked() {
+	if kr.path == "" {
+		return
+	}
+	err := func() error {
+		f := keyringFile{Base: kr.base}
+		var err error
+		if f.Current, err = storeKey(kr.current, time.Time{}); err != nil {
+			return err
+		}
+		if kr.next != nil {
+			s, err := storeKey(kr.next, kr.nextAt)
+			if err != nil {
+				return err
+			}
+			f.Next = &s
+		}
+		for _, rk := range kr.retired {
+			s, err := storeKey(rk.key, rk.retireAt)
+			if err != nil {
+				return err
+			}
+			f.Retired = append(f.Retired, s)
+		}
+		return writeJSONFile(kr.path, f)
+	}()
+	if err != nil {
+		slog.Error("keyring save", "err", err)
+	}
+}
+
+// RunRotation rotates the signing key every interval until ctx is done.
+func (j *JWTAuth) RunRotation(ctx context.Context, every time.Duration) {
+	tick := time.NewTicker(every)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			k, at, err := j.keys.Rotate()
+			if err != nil {
+				slog.Error("scheduled key rotation", "err", err)
+				continue
+			}
+			j.Audit.Record(nil, "key_rotated", "", "kid", k.kid, "alg", k.method.Alg(),
+				"signing_from", at.UTC().Format(time.RFC3339), "by", "schedule")
+		}
+	}
+}
+
+func generateLike(k *signingKey) (*signingKey, error) {
+	switch p := k.sign.(type) {
+	case []byte:
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, fmt.Errorf("generate secret: %w", err)
+		}
+		return hmacKey(secret), nil
+	case *rsa.PrivateKey:
+		priv, err := rsa.GenerateKey(rand.Reader, p.N.BitLen())
+		if err != nil {
+			return nil, fmt.Errorf("generate rsa key: %w", err)
+		}
+		return newSigningKey(priv)
+	case *ecdsa.PrivateKey:
+		priv, err := ecdsa.GenerateKey(p.Curve, rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("generate ec key: %w", err)
+		}
+		return newSigningKey(priv)
+	case ed25519.PrivateKey:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("generate ed25519 key: %w", err)
+		}
+		return newSigningKey(priv)
+	default:
+		return nil, fmt.Errorf("cannot rotate key type %T", k.sign)
+	}
+}
+
+// POST /admin/keys/rotate
+func (j *JWTAuth) HandleRotate(w http.ResponseWriter, r *http.Request) {
+	k, at, err := j.keys.Rotate()
+	if err != nil {
+		slog.Error("rotate key", "err", err)
+		jsonError(w, http.StatusInternalServerError, "rotation failed")
+		return
+	}
+	j.Audit.Record(r, "key_rotated", "", "kid", k.kid, "alg", k.method.Alg(),
+		"signing_from", at.UTC().Format(time.RFC3339), "by", "admin")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"kid":          k.kid,
+		"alg":          k.method.Alg(),
+		"signing_from": at.UTC().Format(time.RFC3339),
+	})
+}
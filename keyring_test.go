@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestKeyring_RotationKeepsOldTokens(t *testing.T) {
+	auth := NewJWTAuth(testSecret)
+	old, _ := auth.IssueToken("alice", time.Hour)
+	oldKid := auth.keys.Current().kid
+
+	next, at, err := auth.keys.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The new key is published ahead of signing with it.
+	if auth.keys.Current().kid != oldKid || time.Until(at) < jwksMaxAge-time.Second {
+		t.Fatalf("new key signing from %v, before verifiers could fetch it", at)
+	}
+	if _, ok := auth.keys.Lookup(next.kid); !ok {
+		t.Error("next key not published")
+	}
+	auth.keys.mu.Lock()
+	auth.keys.nextAt = time.Now()
+	auth.keys.mu.Unlock()
+	if auth.keys.Current().kid != next.kid {
+		t.Fatal("rotation did not change kid")
+	}
+
+	if _, err := auth.Validate(old); err != nil {
+		t.Errorf("pre-rotation token rejected: %v", err)
+	}
+	fresh, _ := auth.IssueToken("bob", time.Hour)
+	if _, err := auth.Validate(fresh); err != nil {
+		t.Errorf("post-rotation token rejected: %v", err)
+	}
+}
+
+func TestKeyring_RetiredKeyExpires(t *testing.T) {
+	auth := NewJWTAuth(testSecret)
+	auth.keys.grace, auth.keys.lead = 0, 0
+	old, _ := auth.IssueToken("alice", time.Hour)
+
+	auth.keys.Rotate()
+	time.Sleep(time.Millisecond)
+
+	if _, err := auth.Validate(old); err == nil {
+		t.Error("token signed by retired key still validates")
+	}
+	if n := len(auth.keys.Keys()); n != 1 {
+		t.Errorf("verification keys = %d, want 1", n)
+	}
+}
+
+func TestKeyring_RotateAsymmetric(t *testing.T) {
+	for alg, priv := range testKeys(t) {
+		t.Run(alg, func(t *testing.T) {
+			auth, _ := NewJWTAuthFromPEM(writeKeyPEM(t, priv))
+			k, _, err := auth.keys.Rotate()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if k.method.Alg() != alg {
+				t.Errorf("alg = %s", k.method.Alg())
+			}
+
+			// Both keys are published, the new one ahead of use.
+			rec := httptest.NewRecorder()
+			auth.HandleJWKS(rec, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+			var set struct{ Keys []jwk }
+			json.NewDecoder(rec.Body).Decode(&set)
+			if len(set.Keys) != 2 {
+				t.Errorf("jwks has %d keys, want 2", len(set.Keys))
+			}
+		})
+	}
+}
+
+func TestHandleRotate_AdminOnly(t *testing.T) {
+	auth := NewJWTAuth(testSecret)
+	before := auth.keys.Current().kid
+
+	cases := []struct {
+		name   string
+		token  string
+		header string
+		want   int
+	}{
+		{"disabled", "", "Bearer x", 404},
+		{"no header", "admin", "", 401},
+		{"wrong token", "admin", "Bearer nope", 401},
+		{"ok", "admin", "Bearer admin", 200},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			h := adminOnly(tc.token, auth, auth.HandleRotate)
+			req := httptest.NewRequest("POST", "/admin/keys/rotate", nil)
+			if tc.header != "" {
+				req.Header.Set("Authorization", tc.header)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tc.want {
+				t.Errorf("got %d, want %d", rec.Code, tc.want)
+			}
+		})
+	}
+
+	if auth.keys.next == nil || auth.keys.Current().kid != before {
+		t.Error("authorized call did not publish a next key")
+	}
+}
+
+func TestKeyring_Persist(t *testing.T) {
+	cfg := Config{DataDir: t.TempDir(), JWTSecret: testSecret, JWTIssuer: defaultIssuer}
+	auth, err := NewJWTAuthFromConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth.keys.lead = 0
+	old, _ := auth.IssueToken("alice", time.Hour)
+	auth.keys.Rotate()
+	fresh, _ := auth.IssueToken("bob", time.Hour)
+	pending, _, _ := func() (*signingKey, time.Time, error) {
+		auth.keys.lead = time.Hour
+		return auth.keys.Rotate()
+	}()
+
+	// A restart keeps the rotated keys, the pending one included.
+	restarted, err := NewJWTAuthFromConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tok := range []string{old, fresh} {
+		if _, err := restarted.Validate(tok); err != nil {
+			t.Errorf("token lost in restart: %v", err)
+		}
+	}
+	if restarted.keys.Current().kid != auth.keys.Current().kid {
+		t.Error("restart went back to the configured key")
+	}
+	if _, ok := restarted.keys.Lookup(pending.kid); !ok {
+		t.Error("pending key lost in restart")
+	}
+
+	// A new configured key signs straight away; the saved ones still verify.
+	cfg.JWTSecret = "another-secret"
+	changed, err := NewJWTAuthFromConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed.keys.Current().kid != hmacKey([]byte("another-secret")).kid {
+		t.Error("configured key not signing")
+	}
+	if _, err := changed.Validate(fresh); err != nil {
+		t.Errorf("saved key dropped: %v", err)
+	}
+}
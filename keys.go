@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// signingKey is a single key JWTAuth can sign and verify with. For HMAC
+// both halves are the shared secret; for everything else sign is the
+// private key and verify the matching public key.
+type signingKey struct {
+	kid    string
+	method jwt.SigningMethod
+	sign   any
+	verify any
+}
+
+func hmacKey(secret []byte) *signingKey {
+	// The kid only needs to be stable, not secret-derived in a useful
+	// way, so a truncated hash is fine here.
+	sum := sha256.Sum256(secret)
+	return &signingKey{
+		kid:    "hs-" + hex.EncodeToString(sum[:6]),
+		method: jwt.SigningMethodHS256,
+		sign:   secret,
+		verify: secret,
+	}
+}
+
+// loadPrivateKey reads an RSA, ECDSA or Ed25519 private key from a PEM
+// file. PKCS#8, PKCS#1 and SEC1 encodings are accepted.
+func loadPrivateKey(path string) (*signingKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM block found", path)
+	}
+
+	var priv any
+	switch block.Type {
+	case "PRIVATE KEY":
+		priv, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		priv, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		priv, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%s: unsupported PEM type %q", path, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse key %s: %w", path, err)
+	}
+	return newSigningKey(priv)
+}
+
+func newSigningKey(priv any) (*signingKey, error) {
+	k := &signingKey{sign: priv}
+	switch p := priv.(type) {
+	case *rsa.PrivateKey:
+		if p.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("rsa key too small: %d bits", p.N.BitLen())
+		}
+		k.method, k.verify = jwt.SigningMethodRS256, &p.PublicKey
+	case *ecdsa.PrivateKey:
+		switch p.Curve {
+		case elliptic.P256():
+			k.method = jwt.SigningMethodES256
+		case elliptic.P384():
+			k.method = jwt.SigningMethodES384
+		case elliptic.P521():
+			k.method = jwt.SigningMethodES512
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", p.Curve.Params().Name)
+		}
+		k.verify = &p.PublicKey
+	case ed25519.PrivateKey:
+		k.method, k.verify = jwt.SigningMethodEdDSA, p.Public()
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", priv)
+	}
+
+	j, err := publicJWK(k.verify)
+	if err != nil {
+		return nil, err
+	}
+	k.kid = j.thumbprint()
+	return k, nil
+}
+
+// jwk is the subset of RFC 7517 we need to publish (and, for OIDC,
+// consume) RSA, EC and OKP public keys.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+var b64 = base64.RawURLEncoding
+
+func publicJWK(pub any) (jwk, error) {
+	switch p := pub.(type) {
+	case *rsa.PublicKey:
+		return jwk{
+			Kty: "RSA",
+			N:   b64.EncodeToString(p.N.Bytes()),
+			E:   b64.EncodeToString(big.NewInt(int64(p.E)).Bytes()),
+		}, nil
+	case *ecdsa.PublicKey:
+		ek, err := p.ECDH()
+		if err != nil {
+			return jwk{}, fmt.Errorf("ec key: %w", err)
+		}
+		// Uncompressed point: 0x04 || X || Y, each coordinate fixed width.
+		raw := ek.Bytes()[1:]
+		n := len(raw) / 2
+		return jwk{
+			Kty: "EC",
+			Crv: p.Curve.Params().Name,
+			X:   b64.EncodeToString(raw[:n]),
+			Y:   b64.EncodeToString(raw[n:]),
+		}, nil
+	case ed25519.PublicKey:
+		return jwk{Kty: "OKP", Crv: "Ed25519", X: b64.EncodeToString(p)}, nil
+	default:
+		return jwk{}, fmt.Errorf("unsupported public key type %T", pub)
+	}
+}
+
+// thumbprint is the RFC 7638 JWK thumbprint, used as our kid. The
+// members have to be in lexicographic order, hence the hand-rolled JSON.
+func (j jwk) thumbprint() string {
+	var canon string
+	switch j.Kty {
+	case "RSA":
+		canon = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, j.E, j.N)
+	case "EC":
+		canon = fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`, j.Crv, j.X, j.Y)
+	case "OKP":
+		canon = fmt.Sprintf(`{"crv":%q,"kty":"OKP","x":%q}`, j.Crv, j.X)
+	}
+	sum := sha256.Sum256([]byte(canon))
+	return b64.EncodeToString(sum[:])
+}
+
+// publicKey is the inverse of publicJWK, for keys fetched from a JWKS.
+func (j jwk) publicKey() (any, error) {
+	switch j.Kty {
+	case "RSA":
+		n, err := b64.DecodeString(j.N)
+		if err != nil {
+			return nil, fmt.Errorf("jwk n: %w", err)
+		}
+		e, err := b64.DecodeString(j.E)
+		if err != nil {
+			return nil, fmt.Errorf("jwk e: %w", err)
+		}
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if pub.N.BitLen() < 2048 || pub.E < 3 {
+			return nil, fmt.Errorf("jwk %s: weak rsa key", j.Kid)
+		}
+		return pub, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch j.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("jwk %s: unsupported curve %q", j.Kid, j.Crv)
+		}
+		x, err := b64.DecodeString(j.X)
+		if err != nil {
+			return nil, fmt.Errorf("jwk x: %w", err)
+		}
+		y, err := b64.DecodeString(j.Y)
+		if err != nil {
+			return nil, fmt.Errorf("jwk y: %w", err)
+		}
+		pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		// ECDH conversion rejects points that aren't on the curve.
+		if _, err := pub.ECDH(); err != nil {
+			return nil, fmt.Errorf("jwk %s: %w", j.Kid, err)
+		}
+		return pub, nil
+	case "OKP":
+		if j.Crv != "Ed25519" {
+			return nil, fmt.Errorf("jwk %s: unsupported curve %q", j.Kid, j.Crv)
+		}
+		x, err := b64.DecodeString(j.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("jwk %s: bad ed25519 key", j.Kid)
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("jwk %s: unsupported kty %q", j.Kid, j.Kty)
+	}
+}
+
+// publicJWK returns the publishable form of k. HMAC keys have no public
+// half and are never published.
+func (k *signingKey) publicJWK() (jwk, bool) {
+	if _, ok := k.sign.(crypto.Signer); !ok {
+		return jwk{}, false
+	}
+	j, err := publicJWK(k.verify)
+	if err != nil {
+		return jwk{}, false
+	}
+	j.Kid, j.Use, j.Alg = k.kid, "sig", k.method.Alg()
+	return j, true
+}
+
+// GET /.well-known/jwks.json — public keys for downstream verifiers.
+func (j *JWTAuth) HandleJWKS(w http.ResponseWriter, r *http.Request) {
+	keys := []jwk{}
+	for _, k := range j.keys.Keys() {
+		if pub, ok := k.publicJWK(); ok {
+			keys = append(keys, pub)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(jwksMaxAge.Seconds())))
+	json.NewEncoder(w).Encode(map[string][]jwk{"keys": keys})
+}
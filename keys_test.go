@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func writeKeyPEM(t *testing.T, priv any) string {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "key.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func testKeys(t *testing.T) map[string]any {
+	t.Helper()
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	return map[string]any{"RS256": rsaKey, "ES256": ecKey, "EdDSA": edKey}
+}
+
+func TestPEMAuth_RoundTrip(t *testing.T) {
+	for alg, priv := range testKeys(t) {
+		t.Run(alg, func(t *testing.T) {
+			auth, err := NewJWTAuthFromPEM(writeKeyPEM(t, priv))
+			if err != nil {
+				t.Fatal(err)
+			}
+			tok, err := auth.IssueToken("alice", time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			parsed, _, _ := jwt.NewParser().ParseUnverified(tok, &jwt.RegisteredClaims{})
+			if parsed.Header["alg"] != alg {
+				t.Errorf("alg = %v", parsed.Header["alg"])
+			}
+			if parsed.Header["kid"] != auth.keys.Current().kid {
+				t.Errorf("kid = %v, want %s", parsed.Header["kid"], auth.keys.Current().kid)
+			}
+
+			claims, err := auth.Validate(tok)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claims.Subject != "alice" {
+				t.Errorf("subject = %q", claims.Subject)
+			}
+		})
+	}
+}
+
+func TestPEMAuth_RejectsHMACConfusion(t *testing.T) {
+	priv, _ := rsa.GenerateKey(rand.Reader, 2048)
+	auth, err := NewJWTAuthFromPEM(writeKeyPEM(t, priv))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Classic alg confusion: HS256 signed with the public key bytes.
+	pubDER, _ := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	forged, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		Subject: "mallory", ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}).SignedString(pubDER)
+
+	if _, err := auth.Validate(forged); err == nil {
+		t.Error("expected rejection")
+	}
+}
+
+func TestLoadPrivateKey_Errors(t *testing.T) {
+	dir := t.TempDir()
+	notPEM := filepath.Join(dir, "garbage")
+	os.WriteFile(notPEM, []byte("hello"), 0o600)
+
+	small, _ := rsa.GenerateKey(rand.Reader, 1024)
+
+	for name, path := range map[string]string{
+		"missing":   filepath.Join(dir, "nope"),
+		"not pem":   notPEM,
+		"small rsa": writeKeyPEM(t, small),
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := loadPrivateKey(path); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
+
+func TestHandleJWKS(t *testing.T) {
+	for alg, priv := range testKeys(t) {
+		t.Run(alg, func(t *testing.T) {
+			auth, _ := NewJWTAuthFromPEM(writeKeyPEM(t, priv))
+			rec := httptest.NewRecorder()
+			auth.HandleJWKS(rec, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+
+			var set struct{ Keys []jwk }
+			if err := json.NewDecoder(rec.Body).Decode(&set); err != nil {
+				t.Fatal(err)
+			}
+			if len(set.Keys) != 1 {
+				t.Fatalf("got %d keys", len(set.Keys))
+			}
+			k := set.Keys[0]
+			if k.Kid != auth.keys.Current().kid || k.Alg != alg || k.Use != "sig" {
+				t.Errorf("unexpected jwk %+v", k)
+			}
+			if k.thumbprint() != k.Kid {
+				t.Error("kid is not the RFC 7638 thumbprint")
+			}
+		})
+	}
+
+	t.Run("hmac not published", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		NewJWTAuth(testSecret).HandleJWKS(rec, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+		var set struct{ Keys []jwk }
+		json.NewDecoder(rec.Body).Decode(&set)
+		if len(set.Keys) != 0 {
+			t.Errorf("secret key leaked into JWKS: %+v", set.Keys)
+		}
+	})
+}
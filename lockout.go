@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	authFailures = expvar.NewInt("auth_failures")
+	authLockouts = expvar.NewInt("auth_lockouts")
+)
+
+// Lockout tracks authentication failures per key (a client IP, a client
+// id) and locks a key out once it fails threshold times within window.
+// Each lockout of the same key lasts twice as long as the last, up to
+// max. A success clears only the credential's own key; address keys age
+// out, so a caller holding one good credential can't reset its guesses at
+// others. Addresses in the allowlist are never tracked.
+//
+// A nil *Lockout is valid and never locks anything out.
+type Lockout struct {
+	threshold int
+	window    time.Duration
+	base, max time.Duration
+	allow     []netip.Prefix
+
+	mu      sync.Mutex
+	entries map[string]*lockEntry
+}
+
+type lockEntry struct {
+	failures int
+	first    time.Time // start of the current failure window
+	until    time.Time // locked out until
+	strikes  int       // lockouts so far, drives the backoff
+	last     time.Time
+}
+
+func NewLockout(threshold int, window, base, max time.Duration, allow []string) (*Lockout, error) {
+	l := &Lockout{
+		threshold: threshold,
+		window:    window,
+		base:      base,
+		max:       max,
+		entries:   map[string]*lockEntry{},
+	}
+	for _, a := range allow {
+		p, err := netip.ParsePrefix(a)
+		if err != nil {
+			addr, aerr := netip.ParseAddr(a)
+			if aerr != nil {
+				return nil, fmt.Errorf("lockout allowlist %q: %w", a, err)
+			}
+			p = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		l.allow = append(l.allow, p.Masked())
+	}
+	return l, nil
+}
+
+func ipKey(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+func (l *Lockout) allowed(key string) bool {
+	ip, ok := strings.CutPrefix(key, "ip:")
+	if !ok {
+		return false
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range l.allow {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check reports whether any of keys is locked out, and for how long.
+func (l *Lockout) Check(keys ...string) (time.Duration, bool) {
+	if l == nil {
+		return 0, false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	var wait time.Duration
+	for _, k := range keys {
+		if e, ok := l.entries[k]; ok && now.Before(e.until) {
+			wait = max(wait, e.until.Sub(now))
+		}
+	}
+	return wait, wait > 0
+}
+
+// Fail records a failed attempt against each key.
+func (l *Lockout) Fail(keys ...string) {
+	if l == nil {
+		return
+	}
+	authFailures.Add(1)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for _, k := range keys {
+		if l.allowed(k) {
+			continue
+		}
+		e, ok := l.entries[k]
+		if !ok {
+			e = &lockEntry{}
+			l.entries[k] = e
+		}
+		if now.Sub(e.first) > l.window {
+			e.failures, e.first = 0, now
+		}
+		e.failures++
+		e.last = now
+
+		if e.failures >= l.threshold {
+			e.strikes++
+			d := time.Duration(float64(l.base) * math.Pow(2, float64(e.strikes-1)))
+			if d > l.max || d <= 0 {
+				d = l.max
+			}
+			e.until, e.failures = now.Add(d), 0
+			authLockouts.Add(1)
+			slog.Warn("auth lockout", "key", k, "duration", d, "strikes", e.strikes)
+		}
+	}
+}
+
+// Succeed forgets earlier failures for each key.
+func (l *Lockout) Succeed(keys ...string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, k := range keys {
+		delete(l.entries, k)
+	}
+}
+
+// GC drops entries that are neither locked nor have failed recently. A
+// key quiet for longer than max loses its strikes too.
+func (l *Lockout) GC() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for k, e := range l.entries {
+		if now.After(e.until) && now.Sub(e.last) > max(l.window, l.max) {
+			delete(l.entries, k)
+		}
+	}
+}
+
+func (l *Lockout) RunGC(ctx context.Context, every time.Duration) {
+	tick := time.NewTicker(every)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			l.GC()
+		}
+	}
+}
+
+// lockedOut writes a 429 and returns true if any of keys is locked out.
+func lockedOut(l *Lockout, w http.ResponseWriter, r *http.Request, keys ...string) bool {
+	wait, locked := l.Check(keys...)
+	if !locked {
+		return false
+	}
+	secs := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	slog.Warn("auth locked out", "addr", r.RemoteAddr, "path", r.URL.Path, "retry_after", secs)
+	jsonError(w, http.StatusTooManyRequests, "too many failed attempts, try again later")
+	return true
+}
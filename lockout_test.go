@@ -0,0 +1,174 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLockout_Middleware(t *testing.T) {
+	auth := NewJWTAuth(testSecret)
+	var err error
+	auth.Lockout, err = NewLockout(3, time.Minute, time.Minute, time.Hour, []string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid, _ := auth.IssueToken("alice", time.Hour)
+	handler := auth.Middleware(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+	do := func(addr, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = addr
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for range 3 {
+		if rec := do("192.0.2.1:1234", "bad"); rec.Code != 401 {
+			t.Fatalf("status = %d, want 401", rec.Code)
+		}
+	}
+	rec := do("192.0.2.1:1234", valid)
+	if rec.Code != 429 {
+		t.Fatalf("locked out caller got %d, want 429", rec.Code)
+	}
+	if s, _ := strconv.Atoi(rec.Header().Get("Retry-After")); s < 59 || s > 60 {
+		t.Errorf("Retry-After = %q", rec.Header().Get("Retry-After"))
+	}
+
+	if rec := do("192.0.2.2:1234", valid); rec.Code != 200 {
+		t.Errorf("other address got %d", rec.Code)
+	}
+	// A good login in between doesn't wipe the address's earlier guesses.
+	do("192.0.2.2:1234", "bad")
+	do("192.0.2.2:1234", "bad")
+	if rec := do("192.0.2.2:1234", valid); rec.Code != 200 {
+		t.Errorf("valid token got %d", rec.Code)
+	}
+	do("192.0.2.2:1234", "bad")
+	if rec := do("192.0.2.2:1234", valid); rec.Code != 429 {
+		t.Errorf("success reset the address's failures: %d", rec.Code)
+	}
+	for range 5 {
+		do("10.1.2.3:1234", "bad")
+	}
+	if rec := do("10.1.2.3:1234", valid); rec.Code != 200 {
+		t.Errorf("allowlisted address got %d", rec.Code)
+	}
+}
+
+func TestLockout_Backoff(t *testing.T) {
+	l, _ := NewLockout(1, time.Minute, time.Minute, 3*time.Minute, nil)
+	for _, want := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		l.Fail("k")
+		wait, locked := l.Check("k")
+		if !locked || wait > want || wait < want-time.Second {
+			t.Errorf("wait = %v, want %v", wait, want)
+		}
+		l.entries["k"].until = time.Now() // serve the sentence
+	}
+
+	l.Succeed("k")
+	l.Fail("k")
+	if wait, _ := l.Check("k"); wait > time.Minute {
+		t.Errorf("strikes survived success: wait = %v", wait)
+	}
+}
+
+func TestLockout_ClientID(t *testing.T) {
+	auth := newClientAuth(t)
+	auth.Lockout, _ = NewLockout(2, time.Minute, time.Minute, time.Hour, nil)
+
+	post := func(addr, secret string) int {
+		form := url.Values{"grant_type": {"client_credentials"}, "client_id": {"renderer"}, "client_secret": {secret}}
+		req := httptest.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.RemoteAddr = addr
+		rec := httptest.NewRecorder()
+		auth.HandleToken(rec, req)
+		return rec.Code
+	}
+
+	// Spread across addresses so only the client id trips.
+	post("192.0.2.1:1", "wrong")
+	post("192.0.2.2:1", "wrong")
+	if code := post("192.0.2.3:1", "s3cret"); code != 429 {
+		t.Errorf("status = %d, want 429", code)
+	}
+
+	// Success clears the client id but not the address.
+	auth.Lockout, _ = NewLockout(2, time.Minute, time.Minute, time.Hour, nil)
+	post("192.0.2.4:1", "wrong")
+	post("192.0.2.4:1", "s3cret")
+	if _, ok := auth.Lockout.entries["client:renderer"]; ok {
+		t.Error("client failures survived a successful login")
+	}
+	if _, ok := auth.Lockout.entries["ip:192.0.2.4"]; !ok {
+		t.Error("successful login cleared the address")
+	}
+}
+
+func TestLockout_APIKeyID(t *testing.T) {
+	auth := NewJWTAuth(testSecret)
+	auth.APIKeys, _ = OpenAPIKeyStore(filepath.Join(t.TempDir(), "apikeys.json"))
+	auth.Lockout, _ = NewLockout(2, time.Minute, time.Minute, time.Hour, nil)
+	raw, k, _ := auth.APIKeys.Create("cron", Entitlements{}, 0)
+	handler := auth.Middleware(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+
+	do := func(addr, key string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = addr
+		req.Header.Set("X-API-Key", key)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// Guesses at one key id from different addresses lock the id.
+	wrong := apiKeyPrefix + k.ID + "_guess"
+	do("192.0.2.1:1", wrong)
+	do("192.0.2.2:1", wrong)
+	if code := do("192.0.2.3:1", raw); code != 429 {
+		t.Errorf("status = %d, want 429", code)
+	}
+}
+
+func TestLockout_Admin(t *testing.T) {
+	auth := NewJWTAuth(testSecret)
+	auth.Lockout, _ = NewLockout(3, time.Minute, time.Minute, time.Hour, nil)
+	h := adminOnly("admin", auth, func(w http.ResponseWriter, r *http.Request) {})
+
+	do := func(token string) int {
+		req := httptest.NewRequest("GET", "/debug/vars", nil)
+		req.RemoteAddr = "192.0.2.9:1"
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	for range 3 {
+		if code := do("guess"); code != 401 {
+			t.Fatalf("status = %d, want 401", code)
+		}
+	}
+	if code := do("admin"); code != 429 {
+		t.Errorf("locked out caller got %d, want 429", code)
+	}
+}
+
+func TestLockout_Nil(t *testing.T) {
+	var l *Lockout
+	l.Fail("k")
+	l.Succeed("k")
+	if _, locked := l.Check("k"); locked {
+		t.Error("nil lockout locked")
+	}
+}
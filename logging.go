@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"log/slog"
 	"net/http"
 	"time"
@@ -30,20 +31,44 @@ func (sr *statusRecorder) Flush() {
 	}
 }
 
+// logInfo lets handlers deeper in the chain add to the access log line.
+// withLogging wraps the mux, so it never sees the request context that
+// Middleware builds; it hands down a pointer instead.
+type logInfo struct {
+	subject  string
+	auth     string
+	upstream string
+}
+
+type logInfoKey struct{}
+
+func logInfoFrom(ctx context.Context) *logInfo {
+	li, _ := ctx.Value(logInfoKey{}).(*logInfo)
+	return li
+}
+
 func withLogging(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 		sr := &statusRecorder{ResponseWriter: w, status: 200}
+		li := &logInfo{}
 
-		next.ServeHTTP(sr, r)
+		next.ServeHTTP(sr, r.WithContext(context.WithValue(r.Context(), logInfoKey{}, li)))
 
-		slog.Info("http",
+		attrs := []any{
 			"method", r.Method,
 			"path", r.URL.Path,
 			"status", sr.status,
 			"ms", time.Since(start).Milliseconds(),
 			"bytes", sr.bytes,
 			"addr", r.RemoteAddr,
-		)
+		}
+		if li.subject != "" {
+			attrs = append(attrs, "sub", li.subject, "auth", li.auth)
+		}
+		if li.upstream != "" {
+			attrs = append(attrs, "upstream", li.upstream)
+		}
+		slog.Info("http", attrs...)
 	})
 }
@@ -2,12 +2,15 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"expvar"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 	"time"
 )
@@ -15,11 +18,19 @@ import (
 func main() {
 	cfg := loadConfig()
 
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(cfg, os.Args[1:], os.Stdout, os.Stderr))
+	}
+
 	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
 		Level: cfg.LogLevel,
 	})))
 
-	slog.Info("starting", "addr", cfg.ListenAddr, "image", cfg.Image, "port", cfg.ContainerPort)
+	if cfg.ClientAuth != "optional" && cfg.ClientAuth != "require" {
+		fatal("config", fmt.Errorf("bad TLS_CLIENT_AUTH %q, want optional or require", cfg.ClientAuth))
+	}
+
+	slog.Info("starting", "addr", cfg.ListenAddr, "image", cfg.Image, "replicas", cfg.Replicas)
 
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
@@ -31,38 +42,226 @@ func main() {
 		fatal("docker client", err)
 	}
 
-	cid, err := dm.Start(ctx)
-	if err != nil {
-		fatal("start container", err)
+	onDemand := cfg.OnDemandIdle > 0
+	if onDemand && cfg.AutoscaleMax > 0 {
+		fatal("config", fmt.Errorf("ON_DEMAND_IDLE and AUTOSCALE_MAX can't be used together"))
+	}
+
+	var replicas []*Replica
+	if !onDemand {
+		replicas, err = dm.StartReplicas(ctx, cfg.Replicas)
+		if err != nil {
+			fatal("start containers", err)
+		}
 	}
-	slog.Info("container started", "id", cid[:12])
 
 	defer func() {
 		cleanupCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 		defer cancel()
-		if err := dm.Stop(cleanupCtx, cid); err != nil {
+		if err := dm.StopAll(cleanupCtx); err != nil {
 			slog.Error("cleanup failed", "err", err)
 		}
 	}()
 
-	if err := dm.WaitReady(ctx, 30*time.Second); err != nil {
-		fatal("health check", err)
+	if !onDemand {
+		if err := dm.WaitReady(ctx, 30*time.Second); err != nil {
+			fatal("health check", err)
+		}
+		slog.Info("containers ready", "replicas", len(replicas))
 	}
-	slog.Info("container ready")
 
 	// --- auth + proxy ---
 
-	auth := NewJWTAuth(cfg.JWTSecret)
+	auth, err := NewJWTAuthFromConfig(cfg)
+	if err != nil {
+		fatal("signing key", err)
+	}
+
+	key := auth.keys.Current()
+	slog.Info("signing tokens", "alg", key.method.Alg(), "kid", key.kid)
+
+	if cfg.LockoutThreshold > 0 {
+		auth.Lockout, err = NewLockout(cfg.LockoutThreshold, cfg.LockoutWindow, cfg.LockoutBase, cfg.LockoutMax, cfg.LockoutAllow)
+		if err != nil {
+			fatal("lockout", err)
+		}
+		go auth.Lockout.RunGC(ctx, time.Minute)
+	}
+
+	limiter, err := NewRateLimiter(cfg.RateLimit, cfg.RateLimitRoles)
+	if err != nil {
+		fatal("rate limit", err)
+	}
+	if limiter.Presigned, err = ParseRate(cfg.RateLimitPresigned); err != nil {
+		fatal("rate limit", fmt.Errorf("RATE_LIMIT_PRESIGNED: %w", err))
+	}
+	auth.RateLimit = limiter
+	go limiter.RunGC(ctx, time.Minute)
+
+	quotas, err := OpenQuotaStore(filepath.Join(cfg.DataDir, "quota.json"), int64(cfg.QuotaDaily), int64(cfg.QuotaMonthly))
+	if err != nil {
+		fatal("quota store", err)
+	}
+	go quotas.RunGC(ctx, time.Hour)
+	go quotas.RunFlush(ctx, 10*time.Second)
+
+	auth.Audit, err = OpenAuditLog(filepath.Join(cfg.DataDir, "audit.log"))
+	if err != nil {
+		fatal("audit log", err)
+	}
+	defer auth.Audit.Close()
+	go auth.Audit.RunFlush(ctx, 5*time.Second)
+	if cfg.KeyRotation > 0 {
+		go auth.RunRotation(ctx, cfg.KeyRotation)
+	}
+
+	auth.Revocations, err = OpenDenyList(filepath.Join(cfg.DataDir, "revocations.json"))
+	if err != nil {
+		fatal("revocation store", err)
+	}
+	go auth.Revocations.RunGC(ctx, time.Hour)
+
+	auth.Refresh, err = OpenRefreshStore(filepath.Join(cfg.DataDir, "refresh_tokens.json"), cfg.RefreshTTL)
+	if err != nil {
+		fatal("refresh token store", err)
+	}
+	go auth.Refresh.RunGC(ctx, time.Hour)
+
+	if cfg.ClientsFile != "" {
+		auth.Clients, err = LoadClients(cfg.ClientsFile)
+		if err != nil {
+			fatal("clients", err)
+		}
+	} else {
+		slog.Warn("CLIENTS_FILE not set, POST /token is open to anyone")
+	}
+
+	auth.APIKeys, err = OpenAPIKeyStore(filepath.Join(cfg.DataDir, "apikeys.json"))
+	if err != nil {
+		fatal("api key store", err)
+	}
+
+	if cfg.OIDCIssuer != "" {
+		v, err := NewOIDCVerifier(ctx, cfg.OIDCIssuer, cfg.OIDCAudience)
+		if err != nil {
+			fatal("oidc", err)
+		}
+		auth.OIDC = append(auth.OIDC, v)
+		slog.Info("accepting tokens from oidc issuer", "issuer", cfg.OIDCIssuer, "aud", cfg.OIDCAudience)
+	}
+
+	presignKey := []byte(cfg.PresignSecret)
+	if len(presignKey) == 0 {
+		slog.Warn("PRESIGN_SECRET not set, presigned URLs stop working on restart")
+		presignKey = []byte(randomID(32))
+	}
+	auth.Presign = NewPresigner(presignKey)
 
 	tok, _ := auth.IssueToken("dev-user", 24*time.Hour)
 	slog.Info("dev token (24h)", "token", tok)
 
-	upstream, _ := url.Parse(fmt.Sprintf("http://127.0.0.1:%d", cfg.ContainerPort))
-	proxy := newReverseProxy(upstream, cfg.ListenAddr)
+	var tlsCfg *tls.Config
+	if cfg.ClientCA != "" {
+		if cfg.TLSCert == "" {
+			fatal("mtls", fmt.Errorf("TLS_CLIENT_CA needs TLS_CERT and TLS_KEY"))
+		}
+		auth.MTLS, err = NewMTLSAuth(cfg.ClientCA, cfg.ClientCRL, cfg.MTLSIdentities)
+		if err != nil {
+			fatal("mtls", err)
+		}
+		tlsCfg = auth.MTLS.TLSConfig(cfg.ClientAuth == "require")
+	}
+
+	publicAddr, err := cfg.publicOrigin()
+	if err != nil {
+		fatal("config", err)
+	}
+	auth.Presign.BaseURL = publicAddr
+	var targets []*url.URL
+	for _, r := range replicas {
+		targets = append(targets, r.URL())
+	}
+	for _, s := range cfg.Upstreams {
+		u, err := url.Parse(s)
+		if err != nil || u.Host == "" {
+			fatal("upstreams", fmt.Errorf("bad upstream %q", s))
+		}
+		targets = append(targets, u)
+	}
+	if len(targets) == 0 && !onDemand {
+		fatal("upstreams", fmt.Errorf("REPLICAS is 0 and UPSTREAMS is empty"))
+	}
+	proxy, err := NewUpstreamPool(cfg.LBStrategy, targets, publicAddr)
+	if err != nil {
+		fatal("upstreams", err)
+	}
+	proxy.Fall, proxy.Rise, proxy.EjectFor = cfg.UpstreamFall, cfg.UpstreamRise, cfg.EjectFor
+	proxy.HealthPath = cfg.HealthPath
+	if cfg.HealthInterval > 0 {
+		go proxy.RunHealthChecks(ctx, cfg.HealthInterval)
+	}
+	slog.Info("upstreams", "count", len(targets), "strategy", cfg.LBStrategy)
+
+	if cfg.AutoscaleMax > 0 {
+		as := NewAutoscaler(dm, proxy, cfg.AutoscaleMin, cfg.AutoscaleMax)
+		as.TargetInflight, as.TargetLatency = cfg.TargetInflight, cfg.TargetLatency
+		as.UpCooldown, as.DownCooldown = cfg.ScaleUpCooldown, cfg.ScaleDownCooldown
+		as.DrainTimeout = cfg.DrainTimeout
+		go as.Run(ctx, cfg.AutoscaleEvery)
+		slog.Info("autoscaling", "min", cfg.AutoscaleMin, "max", cfg.AutoscaleMax)
+	}
+
+	var upstream http.Handler = proxy
+	if onDemand {
+		od := NewOnDemand(dm, proxy, cfg.Replicas, cfg.OnDemandIdle)
+		go od.RunIdle(ctx, min(cfg.OnDemandIdle/4, time.Minute))
+		upstream = od
+		slog.Info("starting containers on demand", "idle", cfg.OnDemandIdle)
+	}
+
+	upstream = Coalesce(upstream)
+	// Outside the on-demand wrapper, so cache hits don't wake containers.
+	if cfg.RenderCacheMB > 0 {
+		dir := cfg.RenderCacheDir
+		if dir == "" {
+			dir = filepath.Join(cfg.DataDir, "render-cache")
+		}
+		if cfg.RenderCacheDiskMB <= 0 {
+			dir = ""
+		}
+		cache, err := NewRenderCache(int64(cfg.RenderCacheMB)<<20, dir, int64(cfg.RenderCacheDiskMB)<<20)
+		if err != nil {
+			fatal("render cache", err)
+		}
+		upstream = cache.Handler(upstream)
+		quotas.Cache = cache
+	}
+
+	limits := &GenerateLimits{
+		MaxWidth:      int64(cfg.RenderMaxWidth),
+		MaxHeight:     int64(cfg.RenderMaxHeight),
+		MaxIterations: int64(cfg.RenderMaxIterations),
+		Kinds:         cfg.RenderKinds,
+	}
+	auth.Limits = limits
+	upstream = quotas.Handler(upstream)
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("POST /token", auth.HandleToken)
-	mux.Handle("/", auth.Middleware(proxy))
+	mux.Handle("POST /token", limiter.Handler(http.HandlerFunc(auth.HandleToken)))
+	mux.Handle("POST /token/refresh", limiter.Handler(http.HandlerFunc(auth.HandleRefresh)))
+	mux.Handle("POST /introspect", limiter.Handler(http.HandlerFunc(auth.HandleIntrospect)))
+	mux.HandleFunc("GET /.well-known/jwks.json", auth.HandleJWKS)
+	mux.Handle("POST /token/revoke", adminOnly(cfg.AdminToken, auth, auth.HandleRevoke))
+	mux.Handle("DELETE /token", adminOnly(cfg.AdminToken, auth, auth.HandleRevoke))
+	mux.Handle("POST /admin/keys/rotate", adminOnly(cfg.AdminToken, auth, auth.HandleRotate))
+	mux.Handle("GET /admin/upstreams", adminOnly(cfg.AdminToken, auth, proxy.HandleStatus))
+	mux.Handle("GET /debug/vars", adminOnly(cfg.AdminToken, auth, expvar.Handler().ServeHTTP))
+	mux.Handle("GET /quota", auth.Middleware(limiter.Handler(http.HandlerFunc(quotas.HandleStatus))))
+	mux.Handle("POST /presign", auth.Middleware(limiter.Handler(http.HandlerFunc(auth.HandlePresign))))
+	// Bodies are validated before entitlements are checked, so a bad one
+	// is a 400 listing what's wrong rather than a 403.
+	mux.Handle("GET "+presignPath, auth.ServePresigned(limiter.Handler(limits.Handler(Authorize(upstream)))))
+	mux.Handle("/", auth.Middleware(limiter.Handler(limits.Handler(Authorize(upstream)))))
 
 	srv := &http.Server{
 		Addr:         cfg.ListenAddr,
@@ -70,11 +269,18 @@ func main() {
 		ReadTimeout:  30 * time.Second,
 		WriteTimeout: 60 * time.Second,
 		IdleTimeout:  120 * time.Second,
+		TLSConfig:    tlsCfg,
 	}
 
 	go func() {
-		slog.Info("listening", "addr", cfg.ListenAddr)
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		slog.Info("listening", "addr", cfg.ListenAddr, "tls", cfg.TLSCert != "", "mtls", auth.MTLS != nil)
+		var err error
+		if cfg.TLSCert != "" {
+			err = srv.ListenAndServeTLS(cfg.TLSCert, cfg.TLSKey)
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			fatal("serve", err)
 		}
 	}()
@@ -85,6 +291,7 @@ func main() {
 	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 	srv.Shutdown(shutdownCtx)
+	quotas.Flush()
 }
 
 func fatal(msg string, err error) {
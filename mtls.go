@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+var ErrCertRevoked = errors.New("client certificate revoked")
+
+// MTLSAuth authenticates callers by client certificate. Certificates must
+// chain to the configured CA and must not appear on the CRL, which is
+// re-read whenever the file changes.
+type MTLSAuth struct {
+	pool    *x509.CertPool
+	caCerts []*x509.Certificate
+
+	crlPath   string
+	mu        sync.Mutex
+	revoked   map[string]bool // serial, hex
+	crlMod    time.Time
+	overrides map[string]MTLSIdentity
+}
+
+// MTLSIdentity is a per-certificate override from the identities file,
+// keyed by the name identityName picks out of the certificate.
+type MTLSIdentity struct {
+	// Subject to use instead of the certificate name.
+	Subject  string `json:"subject,omitempty"`
+	Disabled bool   `json:"disabled,omitempty"`
+	Entitlements
+}
+
+func NewMTLSAuth(caFile, crlFile, identitiesFile string) (*MTLSAuth, error) {
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("read client ca: %w", err)
+	}
+	m := &MTLSAuth{pool: x509.NewCertPool(), crlPath: crlFile, revoked: map[string]bool{}}
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parse client ca: %w", err)
+		}
+		m.pool.AddCert(cert)
+		m.caCerts = append(m.caCerts, cert)
+	}
+	if len(m.caCerts) == 0 {
+		return nil, fmt.Errorf("%s: no certificates found", caFile)
+	}
+
+	if identitiesFile != "" {
+		if err := readJSONFile(identitiesFile, &m.overrides); err != nil {
+			return nil, err
+		}
+	}
+
+	if crlFile != "" {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if err := m.loadCRLLocked(); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// TLSConfig returns the server-side settings for client certificates.
+// When not required, clients without a certificate can still fall back to
+// bearer tokens or API keys.
+func (m *MTLSAuth) TLSConfig(require bool) *tls.Config {
+	auth := tls.VerifyClientCertIfGiven
+	if require {
+		auth = tls.RequireAndVerifyClientCert
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ClientCAs:  m.pool,
+		ClientAuth: auth,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return nil
+			}
+			if m.isRevoked(cs.PeerCertificates[0]) {
+				return ErrCertRevoked
+			}
+			return nil
+		},
+	}
+}
+
+func (m *MTLSAuth) loadCRLLocked() error {
+	fi, err := os.Stat(m.crlPath)
+	if err != nil {
+		return fmt.Errorf("client crl: %w", err)
+	}
+	data, err := os.ReadFile(m.crlPath)
+	if err != nil {
+		return fmt.Errorf("client crl: %w", err)
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	crl, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return fmt.Errorf("parse crl: %w", err)
+	}
+
+	var signed bool
+	for _, ca := range m.caCerts {
+		if bytes.Equal(crl.RawIssuer, ca.RawSubject) && crl.CheckSignatureFrom(ca) == nil {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return fmt.Errorf("crl %s is not signed by the client ca", m.crlPath)
+	}
+	if !crl.NextUpdate.IsZero() && time.Now().After(crl.NextUpdate) {
+		slog.Warn("client crl is past its next update", "path", m.crlPath, "next_update", crl.NextUpdate)
+	}
+
+	revoked := map[string]bool{}
+	for _, e := range crl.RevokedCertificateEntries {
+		revoked[e.SerialNumber.Text(16)] = true
+	}
+	m.revoked, m.crlMod = revoked, fi.ModTime()
+	slog.Info("loaded client crl", "path", m.crlPath, "revoked", len(revoked))
+	return nil
+}
+
+func (m *MTLSAuth) isRevoked(cert *x509.Certificate) bool {
+	if m.crlPath == "" {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if fi, err := os.Stat(m.crlPath); err == nil && !fi.ModTime().Equal(m.crlMod) {
+		// Keep enforcing the old list if the new one is broken.
+		if err := m.loadCRLLocked(); err != nil {
+			slog.Error("reload client crl", "err", err)
+		}
+	}
+	return m.revoked[cert.SerialNumber.Text(16)]
+}
+
+// identityName picks the name a certificate authenticates as: the first
+// URI SAN (e.g. a SPIFFE id), then DNS SAN, then email, then the CN.
+func identityName(cert *x509.Certificate) string {
+	switch {
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	default:
+		return cert.Subject.CommonName
+	}
+}
+
+// Identify maps a verified TLS connection to an Identity. It returns nil
+// and no error when the client sent no certificate.
+func (m *MTLSAuth) Identify(cs *tls.ConnectionState) (*Identity, error) {
+	if cs == nil || len(cs.VerifiedChains) == 0 {
+		return nil, nil
+	}
+	leaf := cs.VerifiedChains[0][0]
+	// The connection may predate a CRL update.
+	if m.isRevoked(leaf) {
+		return nil, ErrCertRevoked
+	}
+
+	name := identityName(leaf)
+	if name == "" {
+		return nil, errors.New("client certificate has no usable name")
+	}
+	id := &Identity{Subject: name, Method: "mtls", Expires: leaf.NotAfter}
+	if o, ok := m.overrides[name]; ok {
+		if o.Disabled {
+			return nil, fmt.Errorf("client identity %q is disabled", name)
+		}
+		if o.Subject != "" {
+			id.Subject = o.Subject
+		}
+		id.Entitlements = o.Entitlements
+	}
+	return id, nil
+}
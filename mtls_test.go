@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	path string
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	return &testCA{cert: cert, key: key, path: path}
+}
+
+func (ca *testCA) issue(t *testing.T, serial int64, tmpl *x509.Certificate) tls.Certificate {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl.SerialNumber = big.NewInt(serial)
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	if tmpl.ExtKeyUsage == nil {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func (ca *testCA) writeCRL(t *testing.T, path string, serials ...int64) {
+	t.Helper()
+	var entries []x509.RevocationListEntry
+	for _, s := range serials {
+		entries = append(entries, x509.RevocationListEntry{SerialNumber: big.NewInt(s), RevocationTime: time.Now()})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(time.Now().UnixNano()),
+		ThisUpdate:                time.Now(),
+		NextUpdate:                time.Now().Add(time.Hour),
+		RevokedCertificateEntries: entries,
+	}, ca.cert, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0o600)
+}
+
+func TestMTLS_EndToEnd(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	crlPath := filepath.Join(dir, "crl.pem")
+	ca.writeCRL(t, crlPath, 3)
+
+	idPath := filepath.Join(dir, "identities.json")
+	ids, _ := json.Marshal(map[string]MTLSIdentity{
+		"spiffe://corp/renderer": {Subject: "svc-renderer", Entitlements: Entitlements{MaxPixels: 100}},
+		"retired.corp":           {Disabled: true},
+	})
+	os.WriteFile(idPath, ids, 0o600)
+
+	m, err := NewMTLSAuth(ca.path, crlPath, idPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := NewJWTAuth(testSecret)
+	auth.MTLS = m
+
+	var got *Identity
+	srv := httptest.NewUnstartedServer(auth.Middleware(Authorize(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = identityFrom(r.Context())
+	}))))
+	srv.TLS = m.TLSConfig(false)
+	srv.StartTLS()
+	defer srv.Close()
+
+	spiffe, _ := url.Parse("spiffe://corp/renderer")
+	renderer := ca.issue(t, 2, &x509.Certificate{URIs: []*url.URL{spiffe}})
+	plain := ca.issue(t, 4, &x509.Certificate{Subject: pkix.Name{CommonName: "batch-1"}})
+	revoked := ca.issue(t, 3, &x509.Certificate{DNSNames: []string{"stolen.corp"}})
+	disabled := ca.issue(t, 5, &x509.Certificate{DNSNames: []string{"retired.corp"}})
+
+	client := func(cert *tls.Certificate) *http.Client {
+		tr := srv.Client().Transport.(*http.Transport).Clone()
+		if cert != nil {
+			tr.TLSClientConfig.Certificates = []tls.Certificate{*cert}
+		}
+		return &http.Client{Transport: tr}
+	}
+
+	t.Run("override applied", func(t *testing.T) {
+		resp, err := client(&renderer).Get(srv.URL + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 200 {
+			t.Fatalf("status = %d", resp.StatusCode)
+		}
+		if got.Subject != "svc-renderer" || got.Method != "mtls" || got.MaxPixels != 100 {
+			t.Errorf("identity = %+v", got)
+		}
+	})
+
+	t.Run("common name", func(t *testing.T) {
+		resp, err := client(&plain).Get(srv.URL + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 200 || got.Subject != "batch-1" {
+			t.Errorf("status = %d, identity = %+v", resp.StatusCode, got)
+		}
+	})
+
+	t.Run("disabled identity", func(t *testing.T) {
+		resp, err := client(&disabled).Get(srv.URL + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 401 {
+			t.Errorf("status = %d, want 401", resp.StatusCode)
+		}
+	})
+
+	t.Run("revoked at handshake", func(t *testing.T) {
+		resp, err := client(&revoked).Get(srv.URL + "/")
+		if err == nil {
+			resp.Body.Close()
+			t.Fatalf("revoked cert got status %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("no cert falls back to bearer", func(t *testing.T) {
+		resp, err := client(nil).Get(srv.URL + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 401 {
+			t.Errorf("status = %d, want 401", resp.StatusCode)
+		}
+	})
+
+	t.Run("crl reloaded", func(t *testing.T) {
+		time.Sleep(10 * time.Millisecond) // distinct mtime
+		ca.writeCRL(t, crlPath, 3, 4)
+		resp, err := client(&plain).Get(srv.URL + "/")
+		if err == nil {
+			resp.Body.Close()
+			t.Fatalf("newly revoked cert got status %d", resp.StatusCode)
+		}
+	})
+}
+
+func TestMTLS_RejectsForeignCRL(t *testing.T) {
+	ca, other := newTestCA(t), newTestCA(t)
+	crlPath := filepath.Join(t.TempDir(), "crl.pem")
+	other.writeCRL(t, crlPath, 1)
+	if _, err := NewMTLSAuth(ca.path, crlPath, ""); err == nil {
+		t.Error("expected error for CRL signed by another CA")
+	}
+}
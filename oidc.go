@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// How long fetched keys are trusted before a routine refetch.
+	jwksTTL = time.Hour
+	// Unknown kids trigger an early refetch (the IdP may have rotated),
+	// but no more often than this so garbage tokens can't hammer it.
+	jwksMinRefetch = time.Minute
+	// Clock skew tolerated between us and the IdP.
+	oidcLeeway = 30 * time.Second
+)
+
+// Asymmetric only: an IdP never shares an HMAC secret with us, and
+// accepting HS* here would reopen alg confusion against the public keys.
+var oidcAlgs = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+// OIDCVerifier validates tokens minted by an external OpenID Connect
+// provider, using the keys it publishes through discovery.
+type OIDCVerifier struct {
+	issuer   string
+	audience string
+	jwksURL  string
+	hc       *http.Client
+
+	mu      sync.Mutex
+	keys    map[string]any
+	fetched time.Time
+	// refreshing is closed when the JWKS fetch in flight, if any, ends.
+	refreshing chan struct{}
+	// failed is when the last fetch failed, so a down IdP is retried at
+	// most every jwksMinRefetch.
+	failed time.Time
+}
+
+// NewOIDCVerifier runs discovery against issuer and loads its JWKS. An
+// empty audience skips the aud check, which is only sensible if the IdP
+// mints tokens solely for us.
+func NewOIDCVerifier(ctx context.Context, issuer, audience string) (*OIDCVerifier, error) {
+	v := &OIDCVerifier{
+		issuer:   issuer,
+		audience: audience,
+		hc:       &http.Client{Timeout: 10 * time.Second},
+	}
+
+	var disco struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	wellKnown := strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+	if err := v.getJSON(ctx, wellKnown, &disco); err != nil {
+		return nil, fmt.Errorf("oidc discovery: %w", err)
+	}
+	// OIDC Discovery 4.3: the advertised issuer must match exactly.
+	if disco.Issuer != issuer {
+		return nil, fmt.Errorf("oidc discovery: issuer mismatch: got %q, want %q", disco.Issuer, issuer)
+	}
+	if disco.JWKSURI == "" {
+		return nil, fmt.Errorf("oidc discovery: no jwks_uri")
+	}
+	v.jwksURL = disco.JWKSURI
+
+	keys, err := v.fetchKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	v.keys, v.fetched = keys, time.Now()
+	return v, nil
+}
+
+func (v *OIDCVerifier) Issuer() string { return v.issuer }
+
+func (v *OIDCVerifier) getJSON(ctx context.Context, url string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := v.hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (v *OIDCVerifier) fetchKeys(ctx context.Context) (map[string]any, error) {
+	var set struct{ Keys []jwk }
+	if err := v.getJSON(ctx, v.jwksURL, &set); err != nil {
+		return nil, fmt.Errorf("fetch jwks: %w", err)
+	}
+	keys := map[string]any{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			slog.Warn("skipping jwk", "issuer", v.issuer, "kid", k.Kid, "err", err)
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("jwks %s: no usable keys", v.jwksURL)
+	}
+	slog.Debug("loaded jwks", "issuer", v.issuer, "keys", len(keys))
+	return keys, nil
+}
+
+// refreshLocked starts a JWKS fetch unless one is already running, and
+// returns a channel closed when it ends. The fetch runs without v.mu, so
+// requests whose key we already have aren't held up by a slow IdP.
+func (v *OIDCVerifier) refreshLocked() chan struct{} {
+	if v.refreshing != nil {
+		return v.refreshing
+	}
+	done := make(chan struct{})
+	v.refreshing = done
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		keys, err := v.fetchKeys(ctx)
+
+		v.mu.Lock()
+		defer v.mu.Unlock()
+		if err != nil {
+			// Keep serving the old keys if the IdP is briefly unreachable.
+			slog.Warn("jwks refresh", "issuer", v.issuer, "err", err)
+			v.failed = time.Now()
+		} else {
+			v.keys, v.fetched, v.failed = keys, time.Now(), time.Time{}
+		}
+		v.refreshing = nil
+		close(done)
+	}()
+	return done
+}
+
+func (v *OIDCVerifier) keyFor(kid string) (any, error) {
+	v.mu.Lock()
+	age := time.Since(v.fetched)
+	_, known := v.lookupLocked(kid)
+	var refreshed chan struct{}
+	if (age > jwksTTL || (!known && age > jwksMinRefetch)) && time.Since(v.failed) > jwksMinRefetch {
+		refreshed = v.refreshLocked()
+	}
+	v.mu.Unlock()
+
+	// A routine refresh happens in the background; only a kid we've
+	// never seen has to wait for it.
+	if !known && refreshed != nil {
+		<-refreshed
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	k, ok := v.lookupLocked(kid)
+	if !ok {
+		return nil, fmt.Errorf("unknown kid %q for issuer %s", kid, v.issuer)
+	}
+	return k, nil
+}
+
+func (v *OIDCVerifier) lookupLocked(kid string) (any, bool) {
+	if kid == "" && len(v.keys) == 1 {
+		for _, k := range v.keys {
+			return k, true
+		}
+	}
+	k, ok := v.keys[kid]
+	return k, ok
+}
+
+func (v *OIDCVerifier) Validate(raw string) (*Claims, error) {
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods(oidcAlgs),
+		jwt.WithIssuer(v.issuer),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(oidcLeeway),
+	}
+	if v.audience != "" {
+		opts = append(opts, jwt.WithAudience(v.audience))
+	}
+
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(raw, claims, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		return v.keyFor(kid)
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// verifyBearer validates a bearer token from any source we trust: our own
+// keys, or an external IdP picked by the token's (unverified) iss claim.
+// The iss peek only routes; the chosen verifier checks it properly.
+// The returned method says which one accepted it.
+func (j *JWTAuth) verifyBearer(raw string) (*Claims, string, error) {
+	if len(j.OIDC) > 0 {
+		var peek jwt.RegisteredClaims
+		if _, _, err := jwt.NewParser().ParseUnverified(raw, &peek); err == nil {
+			for _, v := range j.OIDC {
+				if peek.Issuer == v.Issuer() {
+					claims, err := v.Validate(raw)
+					if err != nil {
+						return nil, "", err
+					}
+					if j.Revocations != nil && j.Revocations.IsRevoked(&claims.RegisteredClaims) {
+						return nil, "", ErrRevoked
+					}
+					return claims, "oidc", nil
+				}
+			}
+		}
+	}
+	claims, err := j.Validate(raw)
+	return claims, "jwt", err
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// fakeIdP is a minimal OpenID provider: discovery document plus a JWKS
+// whose signing key can be swapped to simulate rotation.
+type fakeIdP struct {
+	*httptest.Server
+	key       *signingKey
+	jwksHits  atomic.Int32
+	badIssuer bool
+	// hold, when set, stalls JWKS fetches until it is closed.
+	hold atomic.Pointer[chan struct{}]
+}
+
+func newFakeIdP(t *testing.T) *fakeIdP {
+	t.Helper()
+	priv, _ := rsa.GenerateKey(rand.Reader, 2048)
+	key, _ := newSigningKey(priv)
+	idp := &fakeIdP{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		iss := idp.URL
+		if idp.badIssuer {
+			iss = "https://evil.example"
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":   iss,
+			"jwks_uri": idp.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		idp.jwksHits.Add(1)
+		if hold := idp.hold.Load(); hold != nil {
+			<-*hold
+		}
+		pub, _ := idp.key.publicJWK()
+		json.NewEncoder(w).Encode(map[string][]jwk{"keys": {pub}})
+	})
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+func (idp *fakeIdP) mint(t *testing.T, claims jwt.RegisteredClaims) string {
+	t.Helper()
+	tok := jwt.NewWithClaims(idp.key.method, claims)
+	tok.Header["kid"] = idp.key.kid
+	s, err := tok.SignedString(idp.key.sign)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func (idp *fakeIdP) claims(aud string) jwt.RegisteredClaims {
+	now := time.Now()
+	return jwt.RegisteredClaims{
+		Issuer:    idp.URL,
+		Subject:   "user@corp",
+		Audience:  jwt.ClaimStrings{aud},
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+	}
+}
+
+func TestOIDC_Validate(t *testing.T) {
+	idp := newFakeIdP(t)
+	v, err := NewOIDCVerifier(context.Background(), idp.URL, "mandelbrot")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	good := idp.mint(t, idp.claims("mandelbrot"))
+	if c, err := v.Validate(good); err != nil {
+		t.Fatal(err)
+	} else if c.Subject != "user@corp" {
+		t.Errorf("subject = %q", c.Subject)
+	}
+
+	wrongAud := idp.mint(t, idp.claims("someone-else"))
+
+	wrongIss := idp.claims("mandelbrot")
+	wrongIss.Issuer = "https://other.example"
+
+	expired := idp.claims("mandelbrot")
+	expired.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Hour))
+
+	notYet := idp.claims("mandelbrot")
+	notYet.NotBefore = jwt.NewNumericDate(time.Now().Add(time.Hour))
+
+	noExp := idp.claims("mandelbrot")
+	noExp.ExpiresAt = nil
+
+	hmacTok, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, idp.claims("mandelbrot")).SignedString([]byte("x"))
+
+	for name, tok := range map[string]string{
+		"wrong aud":  wrongAud,
+		"wrong iss":  idp.mint(t, wrongIss),
+		"expired":    idp.mint(t, expired),
+		"not before": idp.mint(t, notYet),
+		"no exp":     idp.mint(t, noExp),
+		"hmac":       hmacTok,
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := v.Validate(tok); err == nil {
+				t.Error("expected rejection")
+			}
+		})
+	}
+}
+
+func TestOIDC_DiscoveryIssuerMismatch(t *testing.T) {
+	idp := newFakeIdP(t)
+	idp.badIssuer = true
+	if _, err := NewOIDCVerifier(context.Background(), idp.URL, ""); err == nil {
+		t.Error("expected issuer mismatch error")
+	}
+}
+
+func TestOIDC_RefetchOnRotation(t *testing.T) {
+	idp := newFakeIdP(t)
+	v, err := NewOIDCVerifier(context.Background(), idp.URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	priv, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	idp.key, _ = newSigningKey(priv)
+	tok := idp.mint(t, idp.claims("x"))
+
+	// Within the refetch throttle the new kid is unknown...
+	if _, err := v.Validate(tok); err == nil {
+		t.Fatal("expected unknown kid")
+	}
+	hits := idp.jwksHits.Load()
+
+	// ...once it has passed we go back to the IdP and pick it up.
+	v.fetched = time.Now().Add(-2 * jwksMinRefetch)
+	if _, err := v.Validate(tok); err != nil {
+		t.Fatal(err)
+	}
+	if idp.jwksHits.Load() != hits+1 {
+		t.Errorf("jwks fetched %d times, want %d", idp.jwksHits.Load(), hits+1)
+	}
+}
+
+func TestOIDC_SlowRefreshDoesNotBlock(t *testing.T) {
+	idp := newFakeIdP(t)
+	v, err := NewOIDCVerifier(context.Background(), idp.URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok := idp.mint(t, idp.claims("x"))
+
+	hold := make(chan struct{})
+	idp.hold.Store(&hold)
+	v.mu.Lock()
+	v.fetched = time.Now().Add(-2 * jwksTTL)
+	v.mu.Unlock()
+
+	// The keys are due a refresh, and it hangs; tokens signed with a key
+	// we already have still validate meanwhile.
+	for range 3 {
+		done := make(chan error, 1)
+		go func() {
+			_, err := v.Validate(tok)
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("validation waited on the JWKS fetch")
+		}
+	}
+	close(hold)
+	waitFor(t, func() bool {
+		v.mu.Lock()
+		defer v.mu.Unlock()
+		return time.Since(v.fetched) < jwksTTL
+	})
+	if n := idp.jwksHits.Load(); n != 2 {
+		t.Errorf("jwks fetched %d times, want 2", n)
+	}
+}
+
+func TestMiddleware_AcceptsOIDC(t *testing.T) {
+	idp := newFakeIdP(t)
+	v, err := NewOIDCVerifier(context.Background(), idp.URL, "mandelbrot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := NewJWTAuth(testSecret)
+	auth.OIDC = []*OIDCVerifier{v}
+
+	local, _ := auth.IssueToken("alice", time.Hour)
+	handler := auth.Middleware(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+
+	for name, tc := range map[string]struct {
+		tok  string
+		want int
+	}{
+		"idp token":   {idp.mint(t, idp.claims("mandelbrot")), 200},
+		"local token": {local, 200},
+		"idp bad aud": {idp.mint(t, idp.claims("nope")), 401},
+	} {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/generate", nil)
+			req.Header.Set("Authorization", "Bearer "+tc.tok)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tc.want {
+				t.Errorf("got %d, want %d", rec.Code, tc.want)
+			}
+		})
+	}
+}
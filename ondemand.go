@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// OnDemand starts the render containers when the first request needs them
+// and stops them again once nothing has used them for IdleAfter. Requests
+// that arrive while the containers are starting wait for the same startup
+// rather than each starting their own.
+type OnDemand struct {
+	Replicas     int
+	IdleAfter    time.Duration
+	StartTimeout time.Duration
+
+	runner replicaRunner
+	pool   *UpstreamPool
+
+	// lifecycle serialises starting and stopping, so a request that comes
+	// in while we're stopping waits for that to finish before starting.
+	lifecycle sync.Mutex
+
+	mu       sync.Mutex
+	running  []*Replica
+	starting chan struct{} // closed when the current startup is done
+	startErr error
+	active   int // requests holding the containers
+	lastUsed time.Time
+}
+
+func NewOnDemand(runner replicaRunner, pool *UpstreamPool, replicas int, idleAfter time.Duration) *OnDemand {
+	return &OnDemand{
+		Replicas:     max(replicas, 1),
+		IdleAfter:    idleAfter,
+		StartTimeout: 2 * time.Minute,
+		runner:       runner,
+		pool:         pool,
+	}
+}
+
+func (o *OnDemand) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := o.acquire(r.Context()); err != nil {
+		if r.Context().Err() == nil {
+			slog.Error("on-demand start", "err", err)
+			jsonError(w, http.StatusServiceUnavailable, "upstream unavailable")
+		}
+		return
+	}
+	defer o.release()
+	o.pool.ServeHTTP(w, r)
+}
+
+// acquire makes sure the containers are up, starting them if need be,
+// and holds them until release.
+func (o *OnDemand) acquire(ctx context.Context) error {
+	o.mu.Lock()
+	o.active++
+	if o.running != nil {
+		o.mu.Unlock()
+		return nil
+	}
+	if o.starting == nil {
+		o.starting = make(chan struct{})
+		go o.start(o.starting)
+	}
+	ch := o.starting
+	o.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		o.release()
+		return ctx.Err()
+	case <-ch:
+	}
+	o.mu.Lock()
+	err := o.startErr
+	o.mu.Unlock()
+	if err != nil {
+		o.release()
+	}
+	return err
+}
+
+func (o *OnDemand) release() {
+	o.mu.Lock()
+	o.active--
+	o.lastUsed = time.Now()
+	o.mu.Unlock()
+}
+
+// start runs detached from the request that triggered it: that client
+// hanging up shouldn't abort a startup others are waiting on.
+func (o *OnDemand) start(done chan struct{}) {
+	o.lifecycle.Lock()
+	defer o.lifecycle.Unlock()
+	slog.Info("starting containers on demand", "replicas", o.Replicas)
+
+	ctx, cancel := context.WithTimeout(context.Background(), o.StartTimeout)
+	defer cancel()
+	started := make([]*Replica, o.Replicas)
+	errs := make([]error, o.Replicas)
+	var wg sync.WaitGroup
+	for i := range o.Replicas {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			started[i], errs[i] = o.runner.StartReplica(ctx)
+		}()
+	}
+	wg.Wait()
+
+	err := errors.Join(errs...)
+	if err != nil {
+		for _, r := range started {
+			if r != nil {
+				o.runner.Stop(context.Background(), r.ID)
+			}
+		}
+		started = nil
+	}
+	for _, r := range started {
+		o.pool.Add(r.URL())
+	}
+
+	o.mu.Lock()
+	o.running, o.startErr = started, err
+	// A failed start is retried by the next request.
+	o.starting = nil
+	o.mu.Unlock()
+	close(done)
+}
+
+// RunIdle checks every interval whether the containers have sat unused
+// for IdleAfter, and stops them if so.
+func (o *OnDemand) RunIdle(ctx context.Context, every time.Duration) {
+	tick := time.NewTicker(every)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			o.stopIfIdle(ctx)
+		}
+	}
+}
+
+func (o *OnDemand) stopIfIdle(ctx context.Context) bool {
+	o.lifecycle.Lock()
+	defer o.lifecycle.Unlock()
+
+	o.mu.Lock()
+	if o.running == nil || o.active > 0 || time.Since(o.lastUsed) < o.IdleAfter {
+		o.mu.Unlock()
+		return false
+	}
+	replicas, idle := o.running, time.Since(o.lastUsed)
+	o.running = nil
+	o.mu.Unlock()
+
+	slog.Info("stopping idle containers", "replicas", len(replicas), "idle", idle.Round(time.Second))
+	for _, r := range replicas {
+		o.pool.Remove(r.URL())
+		if err := o.runner.Stop(context.WithoutCancel(ctx), r.ID); err != nil {
+			slog.Error("stop idle container", "err", err, "name", r.Name)
+		}
+	}
+	return true
+}
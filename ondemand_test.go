@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOnDemand_SharedStartup(t *testing.T) {
+	runner := newFakeRunner(t, func(w http.ResponseWriter, r *http.Request) {})
+	runner.delay = 50 * time.Millisecond
+	pool, _ := NewUpstreamPool(RoundRobin, nil, ":9090")
+	od := NewOnDemand(runner, pool, 2, time.Hour)
+
+	var wg sync.WaitGroup
+	codes := make([]int, 10)
+	for i := range codes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes[i] = serveGET(od, "/")
+		}()
+	}
+	wg.Wait()
+	for i, code := range codes {
+		if code != 200 {
+			t.Errorf("request %d: status %d", i, code)
+		}
+	}
+	if n := runner.starts.Load(); n != 2 {
+		t.Errorf("%d containers started, want 2", n)
+	}
+	if n := len(pool.Outstanding()); n != 2 {
+		t.Errorf("pool has %d upstreams, want 2", n)
+	}
+}
+
+func TestOnDemand_IdleStop(t *testing.T) {
+	release := make(chan struct{})
+	runner := newFakeRunner(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+	})
+	pool, _ := NewUpstreamPool(RoundRobin, nil, ":9090")
+	od := NewOnDemand(runner, pool, 1, 20*time.Millisecond)
+	ctx := context.Background()
+
+	if od.stopIfIdle(ctx) {
+		t.Error("stopped before anything started")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		serveGET(od, "/slow")
+		close(done)
+	}()
+	waitFor(t, func() bool { return len(runner.Replicas()) == 1 })
+	time.Sleep(40 * time.Millisecond)
+	if od.stopIfIdle(ctx) {
+		t.Error("stopped with a request in flight")
+	}
+	close(release)
+	<-done
+
+	if od.stopIfIdle(ctx) {
+		t.Error("stopped before the idle period")
+	}
+	time.Sleep(40 * time.Millisecond)
+	if !od.stopIfIdle(ctx) {
+		t.Fatal("not stopped after the idle period")
+	}
+	if n := len(runner.Replicas()); n != 0 {
+		t.Errorf("%d containers left running", n)
+	}
+	if n := len(pool.Outstanding()); n != 0 {
+		t.Errorf("pool has %d upstreams, want 0", n)
+	}
+
+	// The next request brings them back.
+	if code := serveGET(od, "/"); code != 200 {
+		t.Errorf("after restart: status %d", code)
+	}
+	if n := runner.starts.Load(); n != 2 {
+		t.Errorf("%d starts, want 2", n)
+	}
+}
+
+func TestOnDemand_StartFailure(t *testing.T) {
+	runner := newFakeRunner(t, func(w http.ResponseWriter, r *http.Request) {})
+	runner.fail = errors.New("no docker")
+	pool, _ := NewUpstreamPool(RoundRobin, nil, ":9090")
+	od := NewOnDemand(runner, pool, 1, time.Hour)
+
+	if code := serveGET(od, "/"); code != 503 {
+		t.Errorf("status = %d, want 503", code)
+	}
+	runner.mu.Lock()
+	runner.fail = nil
+	runner.mu.Unlock()
+	if code := serveGET(od, "/"); code != 200 {
+		t.Errorf("retry: status = %d, want 200", code)
+	}
+}
+
+func TestOnDemand_ClientGoesAway(t *testing.T) {
+	runner := newFakeRunner(t, func(w http.ResponseWriter, r *http.Request) {})
+	runner.delay = 100 * time.Millisecond
+	pool, _ := NewUpstreamPool(RoundRobin, nil, ":9090")
+	od := NewOnDemand(runner, pool, 1, time.Hour)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	od.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+
+	// The startup carries on for whoever comes next.
+	waitFor(t, func() bool { return len(pool.Outstanding()) == 1 })
+	if code := serveGET(od, "/"); code != 200 {
+		t.Errorf("status = %d", code)
+	}
+	if n := runner.starts.Load(); n != 1 {
+		t.Errorf("%d starts, want 1", n)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	presignPath       = "/render"
+	defaultPresignTTL = 24 * time.Hour
+	maxPresignTTL     = 30 * 24 * time.Hour
+)
+
+var (
+	ErrBadSignature     = errors.New("invalid signature")
+	ErrPresignedExpired = errors.New("link expired")
+)
+
+// Presigner signs GET /render URLs that stand in for an authenticated
+// POST /generate/, for places like wiki pages that can't send headers.
+// The URL carries the render parameters, who signed it, the token or API
+// key they signed it with and when it expires, all covered by an
+// HMAC-SHA256.
+type Presigner struct {
+	key []byte
+	// BaseURL is the origin links are built on, e.g.
+	// "https://mandelbrot.example.com". Empty gives links relative to
+	// the proxy.
+	BaseURL string
+}
+
+func NewPresigner(secret []byte) *Presigner {
+	return &Presigner{key: secret}
+}
+
+// presigned is what a valid signed URL says.
+type presigned struct {
+	Request GenerateRequest
+	Subject string
+	TokenID string // jti of the token it was signed with, if any
+	KeyID   string // id of the API key it was signed with, if any
+	Issued  time.Time
+	Expires time.Time
+}
+
+// sign MACs the query without sig. url.Values.Encode sorts by key, which
+// gives the canonical form.
+func (p *Presigner) sign(q url.Values) string {
+	q.Del("sig")
+	mac := hmac.New(sha256.New, p.key)
+	io.WriteString(mac, presignPath+"?"+q.Encode())
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// URL returns a signed render link, on BaseURL, bound to the credential
+// id authenticated with.
+func (p *Presigner) URL(req *GenerateRequest, id *Identity, ttl time.Duration) (string, time.Time) {
+	body, _ := json.Marshal(req)
+	now := time.Now()
+	exp := now.Add(ttl)
+	q := url.Values{
+		"p":   {base64.RawURLEncoding.EncodeToString(body)},
+		"sub": {id.Subject},
+		"iat": {strconv.FormatInt(now.Unix(), 10)},
+		"exp": {strconv.FormatInt(exp.Unix(), 10)},
+	}
+	if id.TokenID != "" {
+		q.Set("jti", id.TokenID)
+	}
+	if id.KeyID != "" {
+		q.Set("key", id.KeyID)
+	}
+	q.Set("sig", p.sign(q))
+	return p.BaseURL + presignPath + "?" + q.Encode(), exp
+}
+
+func (p *Presigner) Verify(q url.Values) (*presigned, error) {
+	q = cloneValues(q)
+	got, err := base64.RawURLEncoding.DecodeString(q.Get("sig"))
+	if err != nil {
+		return nil, ErrBadSignature
+	}
+	want, _ := base64.RawURLEncoding.DecodeString(p.sign(q))
+	if !hmac.Equal(got, want) {
+		return nil, ErrBadSignature
+	}
+
+	// Signed by us, so anything malformed past here is our own bug.
+	iat, err1 := strconv.ParseInt(q.Get("iat"), 10, 64)
+	exp, err2 := strconv.ParseInt(q.Get("exp"), 10, 64)
+	body, err3 := base64.RawURLEncoding.DecodeString(q.Get("p"))
+	if err := errors.Join(err1, err2, err3); err != nil {
+		return nil, fmt.Errorf("malformed signed url: %w", err)
+	}
+	ps := &presigned{Subject: q.Get("sub"), TokenID: q.Get("jti"), KeyID: q.Get("key"), Issued: time.Unix(iat, 0), Expires: time.Unix(exp, 0)}
+	if err := json.Unmarshal(body, &ps.Request); err != nil {
+		return nil, fmt.Errorf("malformed signed url: %w", err)
+	}
+	if time.Now().After(ps.Expires) {
+		return nil, ErrPresignedExpired
+	}
+	return ps, nil
+}
+
+func cloneValues(q url.Values) url.Values {
+	out := make(url.Values, len(q))
+	for k, v := range q {
+		out[k] = append([]string(nil), v...)
+	}
+	return out
+}
+
+// POST /presign, behind Middleware. The body is a generate request; the
+// caller's entitlements are checked now, since nobody will be around to
+// check them when the link is used. ?ttl= sets the lifetime, which never
+// outlasts the caller's own credential. Without a jti to revoke, a link
+// lives no longer than a subject revocation is remembered.
+func (j *JWTAuth) HandlePresign(w http.ResponseWriter, r *http.Request) {
+	if j.Presign == nil {
+		jsonError(w, http.StatusNotImplemented, "presigned URLs not enabled")
+		return
+	}
+	id := identityFrom(r.Context())
+	if id == nil {
+		jsonError(w, http.StatusUnauthorized, "authentication required")
+		return
+	}
+
+	ttl := defaultPresignTTL
+	if s := r.URL.Query().Get("ttl"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			jsonError(w, http.StatusBadRequest, "bad ttl: "+s)
+			return
+		}
+		ttl = min(d, maxPresignTTL)
+	}
+	if id.TokenID == "" {
+		ttl = min(ttl, maxTokenTTL)
+	}
+	if !id.Expires.IsZero() {
+		ttl = min(ttl, time.Until(id.Expires))
+		if ttl <= 0 {
+			jsonError(w, http.StatusUnauthorized, "credential expired")
+			return
+		}
+	}
+
+	req, err := readGenerateRequest(r)
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if j.Limits != nil {
+		body, _ := readGenerateBody(r)
+		if _, errs := j.Limits.Validate(body); errs != nil {
+			writeInvalid(w, errs)
+			return
+		}
+	}
+	if d := checkEntitlements(&id.Entitlements, req); d != nil {
+		writeJSON(w, http.StatusForbidden, d)
+		return
+	}
+
+	link, exp := j.Presign.URL(req, id, ttl)
+	slog.Info("presigned render", "sub", id.Subject, "exp", exp)
+	j.Audit.Record(r, "url_presigned", id.Subject, "jti", id.TokenID, "key", id.KeyID, "exp", exp.UTC().Format(time.RFC3339))
+	writeJSON(w, http.StatusOK, map[string]string{
+		"url":     link,
+		"expires": exp.UTC().Format(time.RFC3339),
+	})
+}
+
+// ServePresigned handles GET /render in place of Middleware: it checks the
+// signature and turns the link back into the POST /generate/ it stands
+// for, authenticated as whoever signed it.
+func (j *JWTAuth) ServePresigned(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if j.Presign == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if lockedOut(j.Lockout, w, r, ipKey(r)) {
+			return
+		}
+
+		ps, err := j.Presign.Verify(r.URL.Query())
+		if errors.Is(err, ErrPresignedExpired) {
+			// Old links are expected to linger on pages; they aren't
+			// an attack, so don't count them.
+			jsonError(w, http.StatusGone, err.Error())
+			return
+		}
+		if err != nil {
+			j.authFailed(w, r, err, ErrBadSignature.Error())
+			return
+		}
+		if j.Revocations != nil && j.Revocations.IsRevoked(&jwt.RegisteredClaims{
+			ID:       ps.TokenID,
+			Subject:  ps.Subject,
+			IssuedAt: jwt.NewNumericDate(ps.Issued),
+		}) {
+			j.authFailed(w, r, ErrRevoked, "link revoked")
+			return
+		}
+		if ps.KeyID != "" && (j.APIKeys == nil || !j.APIKeys.Active(ps.KeyID)) {
+			j.authFailed(w, r, ErrBadAPIKey, "link revoked")
+			return
+		}
+
+		body, _ := json.Marshal(ps.Request)
+		r2 := r.Clone(r.Context())
+		r2.Method = http.MethodPost
+		r2.URL.Path, r2.URL.RawPath, r2.URL.RawQuery = "/generate/", "", ""
+		r2.Body = io.NopCloser(bytes.NewReader(body))
+		r2.ContentLength = int64(len(body))
+		r2.Header.Set("Content-Type", "application/json")
+
+		slog.Debug("authed", "sub", ps.Subject, "method", "presigned", "path", r.URL.Path)
+		next.ServeHTTP(w, authenticated(r2, &Identity{Subject: ps.Subject, Method: "presigned"}))
+	})
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPresign_RoundTrip(t *testing.T) {
+	auth, _ := newRevokingAuth(t)
+	auth.Presign = NewPresigner([]byte("presign-secret"))
+	tok, _, _ := auth.issue("wiki-bot", Entitlements{MaxPixels: 500_000}, time.Hour)
+
+	presign := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/presign?ttl=1h", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+tok)
+		rec := httptest.NewRecorder()
+		auth.Middleware(http.HandlerFunc(auth.HandlePresign)).ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := presign(`{"width":1000,"height":1000}`); rec.Code != 403 {
+		t.Errorf("over limit: status = %d, want 403", rec.Code)
+	}
+
+	auth.Limits = testLimits
+	if rec := presign(`{"width":-1}`); rec.Code != 400 {
+		t.Errorf("invalid render: status = %d, want 400", rec.Code)
+	}
+
+	rec := presign(renderBody)
+	if rec.Code != 200 {
+		t.Fatalf("presign status = %d: %s", rec.Code, rec.Body)
+	}
+	var resp map[string]string
+	json.NewDecoder(rec.Body).Decode(&resp)
+	link, _ := url.Parse(resp["url"])
+
+	var gotMethod, gotPath, gotBody string
+	var gotID *Identity
+	handler := auth.ServePresigned(Authorize(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		gotMethod, gotPath, gotBody = r.Method, r.URL.Path, string(b)
+		gotID = identityFrom(r.Context())
+	})))
+	get := func(rawQuery string) int {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/render?"+rawQuery, nil))
+		return rec.Code
+	}
+
+	if code := get(link.RawQuery); code != 200 {
+		t.Fatalf("signed GET status = %d", code)
+	}
+	var want, got GenerateRequest
+	json.Unmarshal([]byte(renderBody), &want)
+	json.Unmarshal([]byte(gotBody), &got)
+	if gotMethod != "POST" || gotPath != "/generate/" || got != want {
+		t.Errorf("upstream saw %s %s %s", gotMethod, gotPath, gotBody)
+	}
+	if gotID == nil || gotID.Subject != "wiki-bot" || gotID.Method != "presigned" {
+		t.Errorf("identity = %+v", gotID)
+	}
+
+	tampered := func(key, val string) string {
+		q := link.Query()
+		q.Set(key, val)
+		return q.Encode()
+	}
+	expired, _ := auth.Presign.URL(&want, &Identity{Subject: "wiki-bot"}, -time.Minute)
+	cases := []struct {
+		name  string
+		query string
+		want  int
+	}{
+		{"bad sig", tampered("sig", "AAAA"), 401},
+		{"no sig", tampered("sig", ""), 401},
+		{"other subject", tampered("sub", "admin"), 401},
+		{"other token", tampered("jti", "x"), 401},
+		{"no token", tampered("jti", ""), 401},
+		{"longer expiry", tampered("exp", "9999999999"), 401},
+		{"expired", strings.TrimPrefix(expired, presignPath+"?"), 410},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if code := get(tc.query); code != tc.want {
+				t.Errorf("status = %d, want %d", code, tc.want)
+			}
+		})
+	}
+
+	auth.Revocations.RevokeSubject("wiki-bot")
+	if code := get(link.RawQuery); code != 401 {
+		t.Errorf("revoked subject: status = %d, want 401", code)
+	}
+}
+
+func TestPresign_BoundToToken(t *testing.T) {
+	auth, _ := newRevokingAuth(t)
+	auth.Presign = NewPresigner([]byte("presign-secret"))
+	auth.Presign.BaseURL = "https://mandelbrot.example.com"
+	tok, claims, _ := auth.issue("wiki-bot", Entitlements{}, 15*time.Minute)
+
+	req := httptest.NewRequest("POST", "/presign?ttl=720h", strings.NewReader(renderBody))
+	req.Host = "evil.example.net"
+	req.Header.Set("Authorization", "Bearer "+tok)
+	rec := httptest.NewRecorder()
+	auth.Middleware(http.HandlerFunc(auth.HandlePresign)).ServeHTTP(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("presign status = %d: %s", rec.Code, rec.Body)
+	}
+	var resp map[string]string
+	json.NewDecoder(rec.Body).Decode(&resp)
+
+	// The link lives no longer than the token, on the configured origin.
+	exp, _ := time.Parse(time.RFC3339, resp["expires"])
+	if exp.After(claims.ExpiresAt.Time) {
+		t.Errorf("link expires %v, after the token's %v", exp, claims.ExpiresAt.Time)
+	}
+	link, _ := url.Parse(resp["url"])
+	if link.Scheme != "https" || link.Host != "mandelbrot.example.com" || link.Path != presignPath {
+		t.Errorf("url = %s", resp["url"])
+	}
+
+	get := func() int {
+		rec := httptest.NewRecorder()
+		auth.ServePresigned(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})).
+			ServeHTTP(rec, httptest.NewRequest("GET", "/render?"+link.RawQuery, nil))
+		return rec.Code
+	}
+	if code := get(); code != 200 {
+		t.Fatalf("signed GET status = %d", code)
+	}
+	// Revoking just the token that signed it kills the link.
+	auth.Revocations.RevokeJTI(claims.ID, claims.ExpiresAt.Time)
+	if code := get(); code != 401 {
+		t.Errorf("revoked jti: status = %d, want 401", code)
+	}
+}
+
+func TestPresign_BoundToAPIKey(t *testing.T) {
+	auth, _ := newRevokingAuth(t)
+	auth.Presign = NewPresigner([]byte("presign-secret"))
+	auth.APIKeys, _ = OpenAPIKeyStore(filepath.Join(t.TempDir(), "apikeys.json"))
+	raw, k, _ := auth.APIKeys.Create("wiki-bot", Entitlements{}, 0)
+
+	req := httptest.NewRequest("POST", "/presign?ttl=720h", strings.NewReader(renderBody))
+	req.Header.Set("X-API-Key", raw)
+	rec := httptest.NewRecorder()
+	auth.Middleware(http.HandlerFunc(auth.HandlePresign)).ServeHTTP(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("presign status = %d: %s", rec.Code, rec.Body)
+	}
+	var resp map[string]string
+	json.NewDecoder(rec.Body).Decode(&resp)
+
+	// With no jti to revoke, the link can't outlive a subject revocation.
+	exp, _ := time.Parse(time.RFC3339, resp["expires"])
+	if time.Until(exp) > maxTokenTTL {
+		t.Errorf("link expires %v, more than %v away", exp, maxTokenTTL)
+	}
+
+	link, _ := url.Parse(resp["url"])
+	get := func() int {
+		rec := httptest.NewRecorder()
+		auth.ServePresigned(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})).
+			ServeHTTP(rec, httptest.NewRequest("GET", "/render?"+link.RawQuery, nil))
+		return rec.Code
+	}
+	if code := get(); code != 200 {
+		t.Fatalf("signed GET status = %d", code)
+	}
+	// Revoking the key that signed it kills the link.
+	auth.APIKeys.Revoke(k.ID)
+	if code := get(); code != 401 {
+		t.Errorf("revoked key: status = %d, want 401", code)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// QuotaStore meters render cost per subject. A render costs
+// width*height*iterations units, charged against a daily and a monthly
+// budget (UTC calendar day and month). Zero budgets are unlimited, but
+// usage is still counted so GET /quota can show it.
+//
+// Usage is kept in memory and saved by Flush, so renders never wait on
+// the disk.
+type QuotaStore struct {
+	Daily   int64
+	Monthly int64
+	// Cache, when set, still answers renders it holds once a budget is
+	// spent, since they cost nothing.
+	Cache *RenderCache
+
+	flushMu sync.Mutex // one Flush at a time
+
+	mu    sync.Mutex
+	path  string
+	usage map[string]*quotaUsage // by subject
+	dirty bool                   // usage changed since the last save
+}
+
+type quotaUsage struct {
+	Day       string `json:"day"` // 2006-01-02
+	DayUsed   int64  `json:"day_used"`
+	Month     string `json:"month"` // 2006-01
+	MonthUsed int64  `json:"month_used"`
+}
+
+// renderCost is what a render is charged.
+func renderCost(req *GenerateRequest) int64 {
+	return req.Width * req.Height * req.Iterations
+}
+
+// OpenQuotaStore loads usage persisted at path. An empty path keeps
+// everything in memory.
+func OpenQuotaStore(path string, daily, monthly int64) (*QuotaStore, error) {
+	q := &QuotaStore{Daily: daily, Monthly: monthly, path: path, usage: map[string]*quotaUsage{}}
+	if path != "" {
+		if err := readJSONFile(path, &q.usage); err != nil {
+			return nil, err
+		}
+	}
+	return q, nil
+}
+
+// current returns sub's usage, starting a new day or month if the clock
+// has moved on. Called with mu held.
+func (q *QuotaStore) current(sub string, now time.Time) *quotaUsage {
+	u, ok := q.usage[sub]
+	if !ok {
+		u = &quotaUsage{}
+		q.usage[sub] = u
+	}
+	now = now.UTC()
+	if day := now.Format(time.DateOnly); u.Day != day {
+		u.Day, u.DayUsed = day, 0
+	}
+	if month := now.Format("2006-01"); u.Month != month {
+		u.Month, u.MonthUsed = month, 0
+	}
+	return u
+}
+
+// quotaDenial says which budget a render would overrun.
+type quotaDenial struct {
+	Error  string    `json:"error"`
+	Period string    `json:"period"`
+	Limit  int64     `json:"limit"`
+	Used   int64     `json:"used"`
+	Cost   int64     `json:"cost"`
+	Resets time.Time `json:"resets"`
+}
+
+// Charge takes cost from sub's budgets, or takes nothing and says which
+// budget it would overrun.
+func (q *QuotaStore) Charge(sub string, cost int64) *quotaDenial {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	u := q.current(sub, now)
+	day, month := periodEnds(now)
+
+	switch {
+	case q.Daily > 0 && u.DayUsed+cost > q.Daily:
+		return &quotaDenial{Error: "daily compute quota exhausted", Period: "daily", Limit: q.Daily, Used: u.DayUsed, Cost: cost, Resets: day}
+	case q.Monthly > 0 && u.MonthUsed+cost > q.Monthly:
+		return &quotaDenial{Error: "monthly compute quota exhausted", Period: "monthly", Limit: q.Monthly, Used: u.MonthUsed, Cost: cost, Resets: month}
+	}
+	u.DayUsed += cost
+	u.MonthUsed += cost
+	q.dirty = true
+	return nil
+}
+
+// Refund gives back a charge for a render that didn't happen.
+func (q *QuotaStore) Refund(sub string, cost int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u := q.current(sub, time.Now())
+	u.DayUsed = max(u.DayUsed-cost, 0)
+	u.MonthUsed = max(u.MonthUsed-cost, 0)
+	q.dirty = true
+}
+
+// Flush saves usage if it has changed since the last save.
+func (q *QuotaStore) Flush() {
+	q.flushMu.Lock()
+	defer q.flushMu.Unlock()
+
+	q.mu.Lock()
+	if !q.dirty || q.path == "" {
+		q.mu.Unlock()
+		return
+	}
+	usage := make(map[string]quotaUsage, len(q.usage))
+	for sub, u := range q.usage {
+		usage[sub] = *u
+	}
+	q.dirty = false
+	q.mu.Unlock()
+
+	if err := writeJSONFile(q.path, usage); err != nil {
+		slog.Error("quota save", "err", err)
+		q.mu.Lock()
+		q.dirty = true
+		q.mu.Unlock()
+	}
+}
+
+// RunFlush flushes every interval until ctx is done. Call Flush once more
+// after the last request has finished.
+func (q *QuotaStore) RunFlush(ctx context.Context, every time.Duration) {
+	tick := time.NewTicker(every)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			q.Flush()
+		}
+	}
+}
+
+// periodEnds returns when the current UTC day and month end.
+func periodEnds(now time.Time) (day, month time.Time) {
+	y, m, d := now.UTC().Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC), time.Date(y, m+1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// GC forgets subjects with nothing used this month.
+func (q *QuotaStore) GC() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	month := time.Now().UTC().Format("2006-01")
+	dropped := 0
+	for sub, u := range q.usage {
+		if u.Month != month {
+			delete(q.usage, sub)
+			dropped++
+		}
+	}
+	if dropped > 0 {
+		q.dirty = true
+	}
+}
+
+func (q *QuotaStore) RunGC(ctx context.Context, every time.Duration) {
+	tick := time.NewTicker(every)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			q.GC()
+		}
+	}
+}
+
+// Handler charges each authenticated POST /generate before passing it
+// on, answering 429 once a budget is spent. Renders that fail are
+// refunded, and so are cache hits and coalesced copies, which cost no
+// compute; cache hits are served even over budget. It expects a body that
+// has already been validated.
+func (q *QuotaStore) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := identityFrom(r.Context())
+		if id == nil || r.Method != http.MethodPost || !isGeneratePath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		req, err := readGenerateRequest(r)
+		if err != nil {
+			jsonError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		cost := renderCost(req)
+		if d := q.Charge(id.Subject, cost); d != nil {
+			if body, err := readGenerateBody(r); err == nil && q.Cache.serveCached(w, r, body) {
+				return
+			}
+			slog.Warn("quota exhausted", "sub", id.Subject, "period", d.Period, "used", d.Used, "cost", cost, "limit", d.Limit)
+			w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(time.Until(d.Resets))))
+			writeJSON(w, http.StatusTooManyRequests, d)
+			return
+		}
+		r, shared := withSharedRender(r)
+		sr := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sr, r)
+		if sr.status >= 400 || shared.Load() {
+			q.Refund(id.Subject, cost)
+		}
+	})
+}
+
+type quotaPeriod struct {
+	Limit     int64     `json:"limit,omitempty"`
+	Used      int64     `json:"used"`
+	Remaining *int64    `json:"remaining,omitempty"`
+	Resets    time.Time `json:"resets"`
+}
+
+type quotaStatus struct {
+	Subject string      `json:"subject"`
+	Daily   quotaPeriod `json:"daily"`
+	Monthly quotaPeriod `json:"monthly"`
+}
+
+// GET /quota — the caller's own budgets. Limits and remaining are left
+// out for unlimited budgets.
+func (q *QuotaStore) HandleStatus(w http.ResponseWriter, r *http.Request) {
+	id := identityFrom(r.Context())
+	if id == nil {
+		jsonError(w, http.StatusUnauthorized, "authentication required")
+		return
+	}
+	q.mu.Lock()
+	now := time.Now()
+	u := q.current(id.Subject, now)
+	st := quotaStatus{Subject: id.Subject}
+	st.Daily.Resets, st.Monthly.Resets = periodEnds(now)
+	st.Daily.Limit, st.Daily.Used = q.Daily, u.DayUsed
+	st.Monthly.Limit, st.Monthly.Used = q.Monthly, u.MonthUsed
+	q.mu.Unlock()
+
+	for _, p := range []*quotaPeriod{&st.Daily, &st.Monthly} {
+		if p.Limit > 0 {
+			rem := max(p.Limit-p.Used, 0)
+			p.Remaining = &rem
+		}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, st)
+}
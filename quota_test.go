@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// costBody asks for a render costing w*h*iter units.
+func costBody(w, h, iter int) string {
+	return fmt.Sprintf(`{"width":%d,"height":%d,"iterations":%d,"re_min":-2,"re_max":1,"im_min":-1,"im_max":1,"kind":"png"}`, w, h, iter)
+}
+
+func TestQuota(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quota.json")
+	q, err := OpenQuotaStore(path, 1000, 1500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstreamStatus := http.StatusOK
+	h := q.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(upstreamStatus)
+	}))
+	render := func(sub, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/generate/", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, withIdentity(req, &Identity{Subject: sub}))
+		return rec
+	}
+
+	steps := []struct {
+		sub, body string
+		upstream  int
+		want      int
+		period    string
+	}{
+		{"alice", costBody(10, 10, 5), 200, 200, ""},      // 500 used
+		{"alice", costBody(10, 10, 4), 200, 200, ""},      // 900
+		{"alice", costBody(10, 10, 2), 200, 429, "daily"}, // would be 1100
+		{"alice", costBody(10, 10, 1), 500, 500, ""},      // refunded
+		{"alice", costBody(10, 10, 1), 200, 200, ""},      // 1000
+		{"bob", costBody(10, 10, 10), 200, 200, ""},       // own budget
+	}
+	for i, s := range steps {
+		upstreamStatus = s.upstream
+		rec := render(s.sub, s.body)
+		if rec.Code != s.want {
+			t.Fatalf("step %d: status %d, want %d: %s", i, rec.Code, s.want, rec.Body)
+		}
+		if s.period != "" {
+			var d quotaDenial
+			json.NewDecoder(rec.Body).Decode(&d)
+			if d.Period != s.period || d.Used != 900 || d.Cost != 200 || rec.Header().Get("Retry-After") == "" {
+				t.Errorf("step %d: denial %+v, Retry-After %q", i, d, rec.Header().Get("Retry-After"))
+			}
+		}
+	}
+
+	// A new day: the daily budget is back but the month still counts.
+	q.usage["alice"].Day = "2000-01-01"
+	upstreamStatus = 200
+	if rec := render("alice", costBody(10, 10, 5)); rec.Code != 200 {
+		t.Errorf("new day: status %d", rec.Code)
+	}
+	rec := render("alice", costBody(10, 10, 1))
+	var d quotaDenial
+	json.NewDecoder(rec.Body).Decode(&d)
+	if rec.Code != 429 || d.Period != "monthly" || d.Used != 1500 {
+		t.Errorf("monthly: status %d, denial %+v", rec.Code, d)
+	}
+
+	// Usage survives a restart once flushed.
+	q.Flush()
+	q2, err := OpenQuotaStore(path, 1000, 1500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u := q2.usage["alice"]; u == nil || u.MonthUsed != 1500 || u.DayUsed != 500 {
+		t.Errorf("reloaded usage = %+v", u)
+	}
+}
+
+func TestQuota_Monthly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quota.json")
+	q, _ := OpenQuotaStore(path, 0, 1000)
+	h := q.Handler(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	render := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/generate/", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, withIdentity(req, &Identity{Subject: "alice"}))
+		return rec
+	}
+
+	for i := range 2 {
+		if rec := render(costBody(10, 10, 5)); rec.Code != 200 {
+			t.Fatalf("render %d: status %d", i, rec.Code)
+		}
+	}
+	rec := render(costBody(1, 1, 1))
+	var d quotaDenial
+	json.NewDecoder(rec.Body).Decode(&d)
+	_, monthEnd := periodEnds(time.Now())
+	if rec.Code != 429 || d.Period != "monthly" || d.Limit != 1000 || d.Used != 1000 || !d.Resets.Equal(monthEnd) {
+		t.Errorf("status %d, denial %+v", rec.Code, d)
+	}
+	if ra, _ := strconv.Atoi(rec.Header().Get("Retry-After")); ra < ceilSeconds(time.Until(monthEnd))-1 {
+		t.Errorf("Retry-After = %d, want until %v", ra, monthEnd)
+	}
+
+	// Nothing touches the disk until a flush.
+	if _, err := os.Stat(path); err == nil {
+		t.Error("usage saved before flush")
+	}
+	q.Flush()
+	if q2, _ := OpenQuotaStore(path, 0, 1000); q2.usage["alice"] == nil || q2.usage["alice"].MonthUsed != 1000 {
+		t.Errorf("reloaded usage = %+v", q2.usage["alice"])
+	}
+
+	// A new month starts from zero.
+	q.usage["alice"].Month = "2000-01"
+	if rec := render(costBody(10, 10, 5)); rec.Code != 200 {
+		t.Errorf("new month: status %d", rec.Code)
+	}
+}
+
+func TestQuota_SharedRendersFree(t *testing.T) {
+	q, _ := OpenQuotaStore("", 0, 0)
+	used := func(sub string) int64 {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		return q.current(sub, time.Now()).DayUsed
+	}
+	render := func(h http.Handler, sub string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/generate/", strings.NewReader(costBody(10, 10, 1)))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, withIdentity(req, &Identity{Subject: sub}))
+		return rec
+	}
+
+	// Only the render that went upstream is charged, not cache hits.
+	var renders atomic.Int64
+	cache, _ := NewRenderCache(1<<20, "", 0)
+	h := q.Handler(cache.Handler(renderBackend(&renders)))
+	render(h, "alice")
+	render(h, "alice")
+	render(h, "bob")
+	if used("alice") != 100 || used("bob") != 0 || renders.Load() != 1 {
+		t.Errorf("cache: alice %d, bob %d, %d renders", used("alice"), used("bob"), renders.Load())
+	}
+
+	// Even once the budget is spent.
+	q.Daily, q.Cache = 100, cache
+	if rec := render(h, "alice"); rec.Code != 200 || rec.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("spent budget, cached render: %d %s", rec.Code, rec.Header().Get("X-Cache"))
+	}
+	req := httptest.NewRequest("POST", "/generate/", strings.NewReader(costBody(20, 20, 1)))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, withIdentity(req, &Identity{Subject: "alice"}))
+	if rec.Code != 429 || renders.Load() != 1 {
+		t.Errorf("spent budget, new render: %d, %d renders", rec.Code, renders.Load())
+	}
+	q.Daily, q.Cache = 0, nil
+
+	// Nor coalesced copies.
+	var hits atomic.Int64
+	release := make(chan struct{})
+	h = q.Handler(Coalesce(blockingBackend(&hits, release, http.StatusOK)))
+	before := renderCoalesced.Value()
+	var wg sync.WaitGroup
+	for _, sub := range []string{"carol", "dave", "erin"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			render(h, sub)
+		}()
+	}
+	waitFor(t, func() bool { return renderCoalesced.Value()-before == 2 })
+	close(release)
+	wg.Wait()
+	if total := used("carol") + used("dave") + used("erin"); total != 100 || hits.Load() != 1 {
+		t.Errorf("coalesced: %d charged for %d renders", total, hits.Load())
+	}
+}
+
+func TestQuota_HandleStatus(t *testing.T) {
+	q, _ := OpenQuotaStore("", 1000, 0)
+	q.Charge("alice", 300)
+
+	rec := httptest.NewRecorder()
+	q.HandleStatus(rec, withIdentity(httptest.NewRequest("GET", "/quota", nil), &Identity{Subject: "alice"}))
+	var st quotaStatus
+	json.NewDecoder(rec.Body).Decode(&st)
+	if st.Subject != "alice" || st.Daily.Limit != 1000 || st.Daily.Used != 300 ||
+		st.Daily.Remaining == nil || *st.Daily.Remaining != 700 {
+		t.Errorf("daily = %+v", st.Daily)
+	}
+	if st.Monthly.Limit != 0 || st.Monthly.Used != 300 || st.Monthly.Remaining != nil {
+		t.Errorf("monthly = %+v", st.Monthly)
+	}
+	if !st.Daily.Resets.After(time.Now()) || st.Monthly.Resets.Before(st.Daily.Resets) {
+		t.Errorf("resets = %v, %v", st.Daily.Resets, st.Monthly.Resets)
+	}
+
+	rec = httptest.NewRecorder()
+	q.HandleStatus(rec, httptest.NewRequest("GET", "/quota", nil))
+	if rec.Code != 401 {
+		t.Errorf("anonymous: status %d", rec.Code)
+	}
+}
+
+func TestPeriodEnds(t *testing.T) {
+	day, month := periodEnds(time.Date(2026, 12, 31, 23, 59, 0, 0, time.UTC))
+	if !day.Equal(time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)) || !month.Equal(day) {
+		t.Errorf("day %v, month %v", day, month)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var rateLimited = expvar.NewInt("rate_limited")
+
+// Rate allows N requests per Per, in a burst of up to N.
+type Rate struct {
+	N   int
+	Per time.Duration
+}
+
+// ParseRate reads "N/s", "N/m" or "N/h". "off" and "0" mean no limit and
+// come back as nil.
+func ParseRate(s string) (*Rate, error) {
+	if s == "off" || s == "0" {
+		return nil, nil
+	}
+	n, unit, ok := strings.Cut(s, "/")
+	per := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}[unit]
+	count, err := strconv.Atoi(n)
+	if !ok || per == 0 || err != nil || count <= 0 {
+		return nil, fmt.Errorf("bad rate %q, want e.g. 60/m", s)
+	}
+	return &Rate{N: count, Per: per}, nil
+}
+
+func (r *Rate) String() string {
+	if r == nil {
+		return "off"
+	}
+	return fmt.Sprintf("%d/%s", r.N, map[time.Duration]string{time.Second: "s", time.Minute: "m", time.Hour: "h"}[r.Per])
+}
+
+// RateLimiter is a token bucket per caller: per subject for
+// authenticated requests, per client IP otherwise. A subject's rate comes
+// from its roles, the most generous one winning, or the default.
+//
+// A nil *RateLimiter is valid and limits nothing.
+type RateLimiter struct {
+	def   *Rate
+	roles map[string]*Rate
+	// Presigned is the rate for GET /render links, per signer, in a
+	// bucket of their own so a popular link doesn't use up the signer's
+	// allowance. Nil leaves links unlimited.
+	Presigned *Rate
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	rate   Rate
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter takes the default rate and "role=rate" overrides.
+func NewRateLimiter(def string, roles []string) (*RateLimiter, error) {
+	d, err := ParseRate(def)
+	if err != nil {
+		return nil, err
+	}
+	l := &RateLimiter{def: d, roles: map[string]*Rate{}, buckets: map[string]*bucket{}}
+	for _, kv := range roles {
+		role, rate, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("bad role rate %q, want role=rate", kv)
+		}
+		if l.roles[role], err = ParseRate(rate); err != nil {
+			return nil, fmt.Errorf("role %s: %w", role, err)
+		}
+	}
+	return l, nil
+}
+
+func (l *RateLimiter) rateFor(id *Identity) *Rate {
+	best, matched := l.def, false
+	for _, role := range id.Roles {
+		r, ok := l.roles[role]
+		if !ok {
+			continue
+		}
+		switch {
+		case r == nil:
+			return nil
+		case !matched || r.perSecond() > best.perSecond():
+			best, matched = r, true
+		}
+	}
+	return best
+}
+
+func (r *Rate) perSecond() float64 {
+	return float64(r.N) / r.Per.Seconds()
+}
+
+type rateState struct {
+	ok        bool
+	remaining int
+	reset     time.Duration // until the bucket is full again
+	retry     time.Duration // until the next request would be allowed
+}
+
+// take spends one token from key's bucket if there is one.
+func (l *RateLimiter) take(key string, rate Rate) rateState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	b, ok := l.buckets[key]
+	if !ok || b.rate != rate {
+		b = &bucket{rate: rate, tokens: float64(rate.N), last: now}
+		l.buckets[key] = b
+	}
+	perToken := rate.Per / time.Duration(rate.N)
+	b.tokens = min(float64(rate.N), b.tokens+float64(now.Sub(b.last))/float64(perToken))
+	b.last = now
+
+	var st rateState
+	if b.tokens >= 1 {
+		b.tokens--
+		st.ok = true
+	} else {
+		st.retry = time.Duration((1 - b.tokens) * float64(perToken))
+	}
+	st.remaining = int(b.tokens)
+	st.reset = time.Duration((float64(rate.N) - b.tokens) * float64(perToken))
+	return st
+}
+
+// Handler rate limits next, setting RateLimit-Limit, -Remaining and
+// -Reset on every response and answering 429 with Retry-After once the
+// caller's bucket is empty. Put it inside Middleware so it sees who the
+// caller is.
+func (l *RateLimiter) Handler(next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if l.Allow(w, r) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// Allow takes one request from r's bucket and sets the RateLimit headers.
+// If the bucket is empty it answers 429 and returns false.
+func (l *RateLimiter) Allow(w http.ResponseWriter, r *http.Request) bool {
+	if l == nil {
+		return true
+	}
+	key, rate := ipKey(r), l.def
+	if id := identityFrom(r.Context()); id != nil {
+		key, rate = "sub:"+id.Subject, l.rateFor(id)
+		if id.Method == "presigned" {
+			key, rate = "presigned:"+id.Subject, l.Presigned
+		}
+	}
+	if rate == nil {
+		return true
+	}
+
+	st := l.take(key, *rate)
+	h := w.Header()
+	h.Set("RateLimit-Limit", strconv.Itoa(rate.N))
+	h.Set("RateLimit-Remaining", strconv.Itoa(st.remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(st.reset)))
+	if !st.ok {
+		rateLimited.Add(1)
+		h.Set("Retry-After", strconv.Itoa(ceilSeconds(st.retry)))
+		slog.Warn("rate limited", "key", key, "rate", rate.String(), "path", r.URL.Path)
+		jsonError(w, http.StatusTooManyRequests, "rate limit exceeded")
+		return false
+	}
+	return true
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// GC drops buckets that have refilled, which are no different from
+// having none.
+func (l *RateLimiter) GC() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for k, b := range l.buckets {
+		if now.Sub(b.last) >= b.rate.Per {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+func (l *RateLimiter) RunGC(ctx context.Context, every time.Duration) {
+	tick := time.NewTicker(every)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			l.GC()
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	cases := []struct {
+		in   string
+		want *Rate
+		ok   bool
+	}{
+		{"60/m", &Rate{60, time.Minute}, true},
+		{"5/s", &Rate{5, time.Second}, true},
+		{"1000/h", &Rate{1000, time.Hour}, true},
+		{"off", nil, true},
+		{"0", nil, true},
+		{"60", nil, false},
+		{"60/d", nil, false},
+		{"-1/m", nil, false},
+		{"x/m", nil, false},
+	}
+	for _, tc := range cases {
+		got, err := ParseRate(tc.in)
+		if (err == nil) != tc.ok {
+			t.Errorf("ParseRate(%q) err = %v", tc.in, err)
+			continue
+		}
+		if (got == nil) != (tc.want == nil) || got != nil && *got != *tc.want {
+			t.Errorf("ParseRate(%q) = %v, want %v", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l, err := NewRateLimiter("3/m", []string{"batch=5/m", "admin=off", "slow=1/m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Presigned = &Rate{4, time.Minute}
+	h := l.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	send := func(id *Identity, addr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/generate/", nil)
+		req.RemoteAddr = addr
+		if id != nil {
+			req = withIdentity(req, id)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	allowed := func(id *Identity, addr string, n int) int {
+		ok := 0
+		for range n {
+			if send(id, addr).Code == 200 {
+				ok++
+			}
+		}
+		return ok
+	}
+
+	cases := []struct {
+		name string
+		id   *Identity
+		addr string
+		want int
+	}{
+		{"default", &Identity{Subject: "alice"}, "10.0.0.1:1", 3},
+		{"same subject, other address", &Identity{Subject: "alice"}, "10.0.0.2:1", 0},
+		{"other subject", &Identity{Subject: "bob"}, "10.0.0.1:1", 3},
+		{"presigned links, own bucket", &Identity{Subject: "alice", Method: "presigned"}, "10.0.0.1:1", 4},
+		{"role", &Identity{Subject: "cron", Entitlements: Entitlements{Roles: []string{"batch"}}}, "10.0.0.1:1", 5},
+		{"most generous role", &Identity{Subject: "mixed", Entitlements: Entitlements{Roles: []string{"slow", "batch"}}}, "10.0.0.1:1", 5},
+		{"unlimited role", &Identity{Subject: "root", Entitlements: Entitlements{Roles: []string{"admin"}}}, "10.0.0.1:1", 10},
+		{"by ip", nil, "10.0.0.9:1", 3},
+		{"other ip", nil, "10.0.0.8:1", 3},
+	}
+	for _, tc := range cases {
+		if got := allowed(tc.id, tc.addr, 10); got != tc.want {
+			t.Errorf("%s: %d of 10 allowed, want %d", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestRateLimiter_Headers(t *testing.T) {
+	l, _ := NewRateLimiter("2/m", nil)
+	h := l.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	id := &Identity{Subject: "alice"}
+
+	steps := []struct {
+		code       int
+		remaining  string
+		retryAfter bool
+	}{
+		{200, "1", false},
+		{200, "0", false},
+		{429, "0", true},
+	}
+	for i, s := range steps {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, withIdentity(httptest.NewRequest("GET", "/", nil), id))
+		hd := rec.Header()
+		if rec.Code != s.code || hd.Get("RateLimit-Limit") != "2" || hd.Get("RateLimit-Remaining") != s.remaining {
+			t.Errorf("step %d: %d limit=%s remaining=%s", i, rec.Code, hd.Get("RateLimit-Limit"), hd.Get("RateLimit-Remaining"))
+		}
+		if reset := hd.Get("RateLimit-Reset"); reset == "" || reset == "0" {
+			t.Errorf("step %d: RateLimit-Reset = %q", i, reset)
+		}
+		if ra := hd.Get("Retry-After"); (ra != "") != s.retryAfter {
+			t.Errorf("step %d: Retry-After = %q", i, ra)
+		}
+	}
+	// One token comes back every 30s.
+	if ra := func() string {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, withIdentity(httptest.NewRequest("GET", "/", nil), id))
+		return rec.Header().Get("Retry-After")
+	}(); ra != "30" {
+		t.Errorf("Retry-After = %s, want 30", ra)
+	}
+}
+
+func TestRateLimiter_Refill(t *testing.T) {
+	l, _ := NewRateLimiter("2/s", nil)
+	rate := Rate{2, time.Second}
+	l.take("k", rate)
+	l.take("k", rate)
+	if st := l.take("k", rate); st.ok {
+		t.Fatal("third request in a burst of 2 allowed")
+	}
+	// Pretend a second went by.
+	l.buckets["k"].last = l.buckets["k"].last.Add(-time.Second)
+	if st := l.take("k", rate); !st.ok || st.remaining != 1 {
+		t.Errorf("after refill: %+v", st)
+	}
+
+	l.buckets["k"].last = l.buckets["k"].last.Add(-time.Second)
+	l.GC()
+	if len(l.buckets) != 0 {
+		t.Error("full bucket not collected")
+	}
+}
+
+func TestRateLimiter_Off(t *testing.T) {
+	off, _ := NewRateLimiter("off", nil)
+	for _, l := range []*RateLimiter{nil, off} {
+		h := l.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		for range 5 {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+			if rec.Code != 200 || rec.Header().Get("RateLimit-Limit") != "" {
+				t.Fatalf("status %d, headers %v", rec.Code, rec.Header())
+			}
+		}
+	}
+}
+
+func TestRateLimiter_Unauthorized(t *testing.T) {
+	auth := NewJWTAuth(testSecret)
+	auth.RateLimit, _ = NewRateLimiter("2/m", nil)
+	h := auth.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for i, want := range []int{401, 401, 429} {
+		req := httptest.NewRequest("GET", "/quota", nil)
+		if i == 1 {
+			req.Header.Set("Authorization", "Bearer nope")
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != want || rec.Header().Get("RateLimit-Limit") != "2" {
+			t.Errorf("request %d: status %d, headers %v", i, rec.Code, rec.Header())
+		}
+	}
+}
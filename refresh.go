@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Access tokens minted from a refresh token are deliberately short; the
+// refresh token is what lets long-running clients keep going.
+const refreshedAccessTTL = time.Hour
+
+var (
+	ErrRefreshInvalid = errors.New("refresh token invalid or expired")
+	ErrRefreshReused  = errors.New("refresh token reused")
+)
+
+// RefreshStore tracks opaque refresh tokens. Each exchange retires the
+// presented token and hands out a new one in the same family. Presenting
+// an already-used token means it was copied somewhere, so the whole
+// family is killed, along with the access token it last minted.
+//
+// Only SHA-256 hashes of the tokens are kept, in memory and on disk.
+type RefreshStore struct {
+	mu     sync.Mutex
+	path   string
+	ttl    time.Duration
+	tokens map[string]*refreshRecord
+}
+
+type refreshRecord struct {
+	Family    string    `json:"family"`
+	Subject   string    `json:"subject"`
+	Created   time.Time `json:"created"` // family start, for subject revocation
+	Expires   time.Time `json:"expires"`
+	Used      bool      `json:"used"`
+	AccessJTI string    `json:"access_jti,omitempty"`
+	AccessExp time.Time `json:"access_exp,omitzero"`
+	// Carried over into every access token the family mints.
+	Entitlements Entitlements `json:"entitlements"`
+
+	// Only filled in on reuse: live access tokens across the family.
+	familyAccess map[string]time.Time
+}
+
+// OpenRefreshStore loads refresh tokens persisted at path; an empty path
+// keeps them in memory only.
+func OpenRefreshStore(path string, ttl time.Duration) (*RefreshStore, error) {
+	s := &RefreshStore{path: path, ttl: ttl, tokens: map[string]*refreshRecord{}}
+	if path != "" {
+		if err := readJSONFile(path, &s.tokens); err != nil {
+			return nil, err
+		}
+	}
+	s.GC()
+	return s, nil
+}
+
+func hashRefresh(tok string) string {
+	sum := sha256.Sum256([]byte(tok))
+	return hex.EncodeToString(sum[:])
+}
+
+// Issue starts a new family for sub and returns its first token.
+func (s *RefreshStore) Issue(sub string, ent Entitlements) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	return s.addLocked(&refreshRecord{
+		Family:       randomID(8),
+		Subject:      sub,
+		Created:      now,
+		Expires:      now.Add(s.ttl),
+		Entitlements: ent,
+	})
+}
+
+func (s *RefreshStore) addLocked(rec *refreshRecord) (string, error) {
+	tok := randomID(32)
+	s.tokens[hashRefresh(tok)] = rec
+	return tok, s.saveLocked()
+}
+
+// Exchange consumes tok and returns its family record plus the
+// replacement token. On reuse the family is dropped and the returned
+// record carries the family's live access tokens, which should now be
+// revoked too.
+func (s *RefreshStore) Exchange(tok string) (*refreshRecord, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec, ok := s.tokens[hashRefresh(tok)]
+	if !ok || time.Now().After(rec.Expires) {
+		return nil, "", ErrRefreshInvalid
+	}
+	if rec.Used {
+		reused := *rec
+		reused.familyAccess = s.familyAccessLocked(rec.Family)
+		s.dropFamilyLocked(rec.Family)
+		return &reused, "", ErrRefreshReused
+	}
+
+	rec.Used = true
+	next := *rec
+	next.Used, next.Expires = false, time.Now().Add(s.ttl)
+	newTok, err := s.addLocked(&next)
+	if err != nil {
+		return nil, "", err
+	}
+	return &next, newTok, nil
+}
+
+// bindAccess remembers which access token a refresh token minted, so
+// reuse detection can revoke it.
+func (s *RefreshStore) bindAccess(tok string, c *Claims) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rec, ok := s.tokens[hashRefresh(tok)]; ok {
+		rec.AccessJTI, rec.AccessExp = c.ID, c.ExpiresAt.Time
+		if err := s.saveLocked(); err != nil {
+			slog.Error("refresh store", "err", err)
+		}
+	}
+}
+
+// familyAccessLocked returns every access token minted in family that
+// hasn't expired yet, keyed by jti.
+func (s *RefreshStore) familyAccessLocked(family string) map[string]time.Time {
+	now, out := time.Now(), map[string]time.Time{}
+	for _, rec := range s.tokens {
+		if rec.Family == family && rec.AccessJTI != "" && rec.AccessExp.After(now) {
+			out[rec.AccessJTI] = rec.AccessExp
+		}
+	}
+	return out
+}
+
+// DropFamily forgets every token in the family.
+func (s *RefreshStore) DropFamily(family string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dropFamilyLocked(family)
+}
+
+// DropSubject forgets every refresh token issued to sub, so a subject
+// revocation outlives the deny list's own retention.
+func (s *RefreshStore) DropSubject(sub string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dropped := 0
+	for h, rec := range s.tokens {
+		if rec.Subject == sub {
+			delete(s.tokens, h)
+			dropped++
+		}
+	}
+	if dropped == 0 {
+		return nil
+	}
+	return s.saveLocked()
+}
+
+func (s *RefreshStore) dropFamilyLocked(family string) {
+	for h, rec := range s.tokens {
+		if rec.Family == family {
+			delete(s.tokens, h)
+		}
+	}
+	if err := s.saveLocked(); err != nil {
+		slog.Error("refresh store", "err", err)
+	}
+}
+
+func (s *RefreshStore) GC() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now, dropped := time.Now(), 0
+	for h, rec := range s.tokens {
+		if now.After(rec.Expires) {
+			delete(s.tokens, h)
+			dropped++
+		}
+	}
+	if dropped > 0 {
+		if err := s.saveLocked(); err != nil {
+			slog.Error("refresh store gc", "err", err)
+		}
+	}
+}
+
+func (s *RefreshStore) RunGC(ctx context.Context, every time.Duration) {
+	tick := time.NewTicker(every)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			s.GC()
+		}
+	}
+}
+
+func (s *RefreshStore) saveLocked() error {
+	if s.path == "" {
+		return nil
+	}
+	return writeJSONFile(s.path, s.tokens)
+}
+
+// POST /token/refresh
+func (j *JWTAuth) HandleRefresh(w http.ResponseWriter, r *http.Request) {
+	if j.Refresh == nil {
+		jsonError(w, http.StatusNotImplemented, "refresh tokens not enabled")
+		return
+	}
+
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, http.StatusBadRequest, "invalid JSON")
+		return
+	}
+	if req.RefreshToken == "" {
+		jsonError(w, http.StatusBadRequest, "refresh_token is required")
+		return
+	}
+
+	rec, next, err := j.Refresh.Exchange(req.RefreshToken)
+	if errors.Is(err, ErrRefreshReused) {
+		slog.Warn("refresh token reuse, revoking family", "sub", rec.Subject, "family", rec.Family, "addr", r.RemoteAddr)
+		j.Audit.Record(r, "refresh_reuse", rec.Subject, "family", rec.Family)
+		if j.Revocations != nil {
+			for jti, exp := range rec.familyAccess {
+				if err := j.Revocations.RevokeJTI(jti, exp); err != nil {
+					slog.Error("revoke jti", "err", err)
+				}
+			}
+		}
+		jsonError(w, http.StatusUnauthorized, ErrRefreshInvalid.Error())
+		return
+	}
+	if err != nil {
+		jsonError(w, http.StatusUnauthorized, ErrRefreshInvalid.Error())
+		return
+	}
+	if j.Revocations != nil && j.Revocations.IsRevoked(&jwt.RegisteredClaims{
+		Subject:  rec.Subject,
+		IssuedAt: jwt.NewNumericDate(rec.Created),
+	}) {
+		j.Refresh.DropFamily(rec.Family)
+		jsonError(w, http.StatusUnauthorized, "subject revoked")
+		return
+	}
+
+	tok, claims, err := j.issue(rec.Subject, rec.Entitlements, refreshedAccessTTL)
+	if err != nil {
+		slog.Error("issue token", "err", err)
+		jsonError(w, http.StatusInternalServerError, "token generation failed")
+		return
+	}
+	j.Refresh.bindAccess(next, claims)
+
+	slog.Info("refreshed token", "sub", rec.Subject, "family", rec.Family)
+	j.Audit.Record(r, "token_refreshed", rec.Subject, "jti", claims.ID, "family", rec.Family)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"token":         tok,
+		"expires_in":    refreshedAccessTTL.String(),
+		"subject":       rec.Subject,
+		"refresh_token": next,
+	})
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newRefreshingAuth(t *testing.T) *JWTAuth {
+	t.Helper()
+	auth, _ := newRevokingAuth(t)
+	rs, err := OpenRefreshStore(filepath.Join(t.TempDir(), "refresh.json"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth.Refresh = rs
+	return auth
+}
+
+func postJSON(h http.HandlerFunc, path string, body any) (int, map[string]string) {
+	data, _ := json.Marshal(body)
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest("POST", path, bytes.NewReader(data)))
+	var resp map[string]string
+	json.NewDecoder(rec.Body).Decode(&resp)
+	return rec.Code, resp
+}
+
+func TestRefresh_Flow(t *testing.T) {
+	auth := newRefreshingAuth(t)
+
+	code, resp := postJSON(auth.HandleToken, "/token", map[string]any{"subject": "renderer", "refresh": true})
+	if code != 200 || resp["refresh_token"] == "" {
+		t.Fatalf("status = %d, resp = %v", code, resp)
+	}
+
+	rt := resp["refresh_token"]
+	for i := range 3 {
+		code, resp = postJSON(auth.HandleRefresh, "/token/refresh", map[string]string{"refresh_token": rt})
+		if code != 200 {
+			t.Fatalf("refresh %d: status = %d", i, code)
+		}
+		if resp["refresh_token"] == rt {
+			t.Fatal("refresh token was not rotated")
+		}
+		claims, err := auth.Validate(resp["token"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claims.Subject != "renderer" {
+			t.Errorf("subject = %q", claims.Subject)
+		}
+		if ttl := time.Until(claims.ExpiresAt.Time); ttl > refreshedAccessTTL {
+			t.Errorf("access ttl = %v", ttl)
+		}
+		rt = resp["refresh_token"]
+	}
+}
+
+func TestRefresh_ReuseRevokesFamily(t *testing.T) {
+	auth := newRefreshingAuth(t)
+
+	_, resp := postJSON(auth.HandleToken, "/token", map[string]any{"subject": "x", "refresh": true})
+	stolen := resp["refresh_token"]
+
+	_, resp = postJSON(auth.HandleRefresh, "/token/refresh", map[string]string{"refresh_token": stolen})
+	access, next := resp["token"], resp["refresh_token"]
+
+	// The attacker replays the original.
+	code, _ := postJSON(auth.HandleRefresh, "/token/refresh", map[string]string{"refresh_token": stolen})
+	if code != 401 {
+		t.Fatalf("reuse status = %d, want 401", code)
+	}
+
+	// Now the legitimate chain is dead too, and so is its access token.
+	code, _ = postJSON(auth.HandleRefresh, "/token/refresh", map[string]string{"refresh_token": next})
+	if code != 401 {
+		t.Errorf("family survived reuse: status = %d", code)
+	}
+	if _, err := auth.Validate(access); !errors.Is(err, ErrRevoked) {
+		t.Errorf("access token err = %v, want ErrRevoked", err)
+	}
+}
+
+func TestRefresh_Rejects(t *testing.T) {
+	auth := newRefreshingAuth(t)
+	expired, _ := auth.Refresh.Issue("x", Entitlements{})
+	for _, rec := range auth.Refresh.tokens {
+		rec.Expires = time.Now().Add(-time.Minute)
+	}
+	revokedSub, _ := auth.Refresh.Issue("mallory", Entitlements{})
+	auth.Revocations.RevokeSubject("mallory")
+
+	cases := []struct {
+		name string
+		body map[string]string
+		want int
+	}{
+		{"missing", map[string]string{}, 400},
+		{"unknown", map[string]string{"refresh_token": "nope"}, 401},
+		{"expired", map[string]string{"refresh_token": expired}, 401},
+		{"subject revoked", map[string]string{"refresh_token": revokedSub}, 401},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if code, _ := postJSON(auth.HandleRefresh, "/token/refresh", tc.body); code != tc.want {
+				t.Errorf("got %d, want %d", code, tc.want)
+			}
+		})
+	}
+
+	for _, rec := range auth.Refresh.tokens {
+		if rec.Subject == "mallory" {
+			t.Error("revoked subject's family was kept")
+		}
+	}
+}
+
+func TestRefresh_RevocationOutlivesDenyList(t *testing.T) {
+	auth := newRefreshingAuth(t)
+	_, resp := postJSON(auth.HandleToken, "/token", map[string]any{"subject": "alice", "refresh": true})
+	alice := resp["refresh_token"]
+	_, resp = postJSON(auth.HandleToken, "/token", map[string]any{"subject": "bob", "refresh": true})
+	bob := resp["refresh_token"]
+
+	rec := httptest.NewRecorder()
+	auth.HandleRevoke(rec, httptest.NewRequest("POST", "/token/revoke", strings.NewReader(`{"subject":"alice"}`)))
+	if rec.Code != 204 {
+		t.Fatalf("revoke status = %d", rec.Code)
+	}
+
+	// Long after the deny list has forgotten alice.
+	auth.Revocations.data.Subjects["alice"] = time.Now().Add(-maxTokenTTL - time.Minute)
+	auth.Revocations.GC()
+
+	if code, _ := postJSON(auth.HandleRefresh, "/token/refresh", map[string]string{"refresh_token": alice}); code != 401 {
+		t.Errorf("revoked subject refreshed: status = %d", code)
+	}
+	if code, _ := postJSON(auth.HandleRefresh, "/token/refresh", map[string]string{"refresh_token": bob}); code != 200 {
+		t.Errorf("other subject: status = %d", code)
+	}
+}
+
+func TestRefresh_Persisted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "refresh.json")
+	rs, _ := OpenRefreshStore(path, time.Hour)
+	tok, _ := rs.Issue("alice", Entitlements{})
+
+	reopened, err := OpenRefreshStore(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, _, err := reopened.Exchange(tok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Subject != "alice" {
+		t.Errorf("subject = %q", rec.Subject)
+	}
+}
+
+func TestHandleToken_RefreshDisabled(t *testing.T) {
+	auth := NewJWTAuth(testSecret)
+	if code, _ := postJSON(auth.HandleToken, "/token", map[string]any{"refresh": true}); code != 400 {
+		t.Errorf("status = %d, want 400", code)
+	}
+}
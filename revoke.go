@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var ErrRevoked = errors.New("token revoked")
+
+// DenyList records revoked tokens, either individually by jti or every
+// token a subject was issued up to a point in time. Entries only need to
+// outlive the tokens they cover, so they are garbage-collected once
+// those tokens would have expired anyway.
+type DenyList struct {
+	mu   sync.Mutex
+	path string
+	data denyListFile
+}
+
+type denyListFile struct {
+	// jti -> expiry of the revoked token
+	JTIs map[string]time.Time `json:"jtis"`
+	// subject -> tokens issued at or before this time are revoked
+	Subjects map[string]time.Time `json:"subjects"`
+}
+
+// OpenDenyList loads the deny list persisted at path. An empty path keeps
+// everything in memory.
+func OpenDenyList(path string) (*DenyList, error) {
+	d := &DenyList{path: path, data: denyListFile{
+		JTIs:     map[string]time.Time{},
+		Subjects: map[string]time.Time{},
+	}}
+	if path != "" {
+		if err := readJSONFile(path, &d.data); err != nil {
+			return nil, err
+		}
+	}
+	d.GC()
+	return d, nil
+}
+
+func (d *DenyList) RevokeJTI(jti string, exp time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.data.JTIs[jti] = exp
+	return d.saveLocked()
+}
+
+func (d *DenyList) RevokeSubject(sub string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.data.Subjects[sub] = time.Now()
+	return d.saveLocked()
+}
+
+func (d *DenyList) IsRevoked(c *jwt.RegisteredClaims) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.data.JTIs[c.ID]; ok && c.ID != "" {
+		return true
+	}
+	if at, ok := d.data.Subjects[c.Subject]; ok {
+		// No iat means we can't prove it postdates the revocation.
+		if c.IssuedAt == nil || !c.IssuedAt.After(at) {
+			return true
+		}
+	}
+	return false
+}
+
+// GC drops entries whose tokens have expired by now.
+func (d *DenyList) GC() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now, dropped := time.Now(), 0
+	for jti, exp := range d.data.JTIs {
+		if now.After(exp) {
+			delete(d.data.JTIs, jti)
+			dropped++
+		}
+	}
+	for sub, at := range d.data.Subjects {
+		if now.After(at.Add(maxTokenTTL)) {
+			delete(d.data.Subjects, sub)
+			dropped++
+		}
+	}
+	if dropped == 0 {
+		return
+	}
+	if err := d.saveLocked(); err != nil {
+		slog.Error("deny list gc", "err", err)
+	}
+	slog.Debug("deny list gc", "dropped", dropped)
+}
+
+func (d *DenyList) RunGC(ctx context.Context, every time.Duration) {
+	tick := time.NewTicker(every)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			d.GC()
+		}
+	}
+}
+
+func (d *DenyList) saveLocked() error {
+	if d.path == "" {
+		return nil
+	}
+	return writeJSONFile(d.path, d.data)
+}
+
+// POST /token/revoke and DELETE /token — admin only. Revokes a single
+// token (by jti, or by passing the token itself) or everything issued to
+// a subject so far.
+func (j *JWTAuth) HandleRevoke(w http.ResponseWriter, r *http.Request) {
+	if j.Revocations == nil {
+		jsonError(w, http.StatusNotImplemented, "revocation not configured")
+		return
+	}
+
+	var req struct {
+		Token   string `json:"token"`
+		JTI     string `json:"jti"`
+		Subject string `json:"subject"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, http.StatusBadRequest, "invalid JSON")
+		return
+	}
+
+	// Without the token we don't know its expiry, so keep the entry for
+	// as long as any token could possibly live.
+	exp := time.Now().Add(maxTokenTTL)
+	if req.Token != "" {
+		claims, err := j.Validate(req.Token)
+		if errors.Is(err, ErrRevoked) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if err != nil {
+			jsonError(w, http.StatusBadRequest, "token is not valid")
+			return
+		}
+		if claims.ID == "" {
+			jsonError(w, http.StatusBadRequest, "token has no jti")
+			return
+		}
+		req.JTI = claims.ID
+		if claims.ExpiresAt != nil {
+			exp = claims.ExpiresAt.Time
+		}
+	}
+
+	if req.JTI == "" && req.Subject == "" {
+		jsonError(w, http.StatusBadRequest, "one of token, jti or subject is required")
+		return
+	}
+
+	if req.JTI != "" {
+		if err := j.Revocations.RevokeJTI(req.JTI, exp); err != nil {
+			slog.Error("revoke jti", "err", err)
+			jsonError(w, http.StatusInternalServerError, "revocation failed")
+			return
+		}
+		slog.Info("revoked token", "jti", req.JTI)
+		j.Audit.Record(r, "token_revoked", "", "jti", req.JTI)
+	}
+	if req.Subject != "" {
+		if err := j.Revocations.RevokeSubject(req.Subject); err != nil {
+			slog.Error("revoke subject", "err", err)
+			jsonError(w, http.StatusInternalServerError, "revocation failed")
+			return
+		}
+		if j.Refresh != nil {
+			if err := j.Refresh.DropSubject(req.Subject); err != nil {
+				slog.Error("drop refresh tokens", "err", err)
+				jsonError(w, http.StatusInternalServerError, "revocation failed")
+				return
+			}
+		}
+		slog.Info("revoked subject", "sub", req.Subject)
+		j.Audit.Record(r, "subject_revoked", req.Subject)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func newRevokingAuth(t *testing.T) (*JWTAuth, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "revocations.json")
+	dl, err := OpenDenyList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := NewJWTAuth(testSecret)
+	auth.Revocations = dl
+	return auth, path
+}
+
+func TestIssueToken_UniqueJTI(t *testing.T) {
+	auth := NewJWTAuth(testSecret)
+	seen := map[string]bool{}
+	for range 10 {
+		tok, _ := auth.IssueToken("alice", time.Hour)
+		c, err := auth.Validate(tok)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.ID == "" || seen[c.ID] {
+			t.Fatalf("bad jti %q", c.ID)
+		}
+		seen[c.ID] = true
+	}
+}
+
+func TestDenyList_RevokeAndPersist(t *testing.T) {
+	auth, path := newRevokingAuth(t)
+	leaked, _ := auth.IssueToken("alice", time.Hour)
+	other, _ := auth.IssueToken("alice", time.Hour)
+	claims, _ := auth.Validate(leaked)
+
+	if err := auth.Revocations.RevokeJTI(claims.ID, claims.ExpiresAt.Time); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := auth.Validate(leaked); !errors.Is(err, ErrRevoked) {
+		t.Errorf("err = %v, want ErrRevoked", err)
+	}
+	if _, err := auth.Validate(other); err != nil {
+		t.Errorf("unrelated token rejected: %v", err)
+	}
+
+	// Survives a restart.
+	reopened, err := OpenDenyList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth.Revocations = reopened
+	if _, err := auth.Validate(leaked); !errors.Is(err, ErrRevoked) {
+		t.Errorf("after reload err = %v, want ErrRevoked", err)
+	}
+}
+
+func TestDenyList_RevokeSubject(t *testing.T) {
+	auth, _ := newRevokingAuth(t)
+	old, _ := auth.IssueToken("alice", time.Hour)
+	bob, _ := auth.IssueToken("bob", time.Hour)
+
+	auth.Revocations.RevokeSubject("alice")
+
+	if _, err := auth.Validate(old); !errors.Is(err, ErrRevoked) {
+		t.Errorf("err = %v, want ErrRevoked", err)
+	}
+	if _, err := auth.Validate(bob); err != nil {
+		t.Errorf("other subject rejected: %v", err)
+	}
+
+	// Tokens issued after the revocation are fine again.
+	auth.Revocations.data.Subjects["alice"] = time.Now().Add(-2 * time.Second)
+	fresh, _ := auth.IssueToken("alice", time.Hour)
+	if _, err := auth.Validate(fresh); err != nil {
+		t.Errorf("post-revocation token rejected: %v", err)
+	}
+}
+
+func TestDenyList_GC(t *testing.T) {
+	dl, _ := OpenDenyList("")
+	dl.RevokeJTI("gone", time.Now().Add(-time.Minute))
+	dl.RevokeJTI("live", time.Now().Add(time.Hour))
+	dl.data.Subjects["old"] = time.Now().Add(-maxTokenTTL - time.Minute)
+
+	dl.GC()
+
+	if _, ok := dl.data.JTIs["gone"]; ok {
+		t.Error("expired jti not collected")
+	}
+	if _, ok := dl.data.JTIs["live"]; !ok {
+		t.Error("live jti collected")
+	}
+	if _, ok := dl.data.Subjects["old"]; ok {
+		t.Error("stale subject not collected")
+	}
+	if !dl.IsRevoked(&jwt.RegisteredClaims{ID: "live"}) {
+		t.Error("live jti not revoked")
+	}
+}
+
+func TestHandleRevoke(t *testing.T) {
+	auth, _ := newRevokingAuth(t)
+	tok, _ := auth.IssueToken("alice", time.Hour)
+	claims, _ := auth.Validate(tok)
+
+	cases := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"empty", `{}`, 400},
+		{"bad json", `{`, 400},
+		{"bad token", `{"token":"nope"}`, 400},
+		{"by token", `{"token":"` + tok + `"}`, 204},
+		{"already revoked", `{"token":"` + tok + `"}`, 204},
+		{"by jti", `{"jti":"` + claims.ID + `"}`, 204},
+		{"by subject", `{"subject":"bob"}`, 204},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			auth.HandleRevoke(rec, httptest.NewRequest("POST", "/token/revoke", strings.NewReader(tc.body)))
+			if rec.Code != tc.want {
+				t.Errorf("got %d, want %d: %s", rec.Code, tc.want, rec.Body)
+			}
+		})
+	}
+
+	if _, err := auth.Validate(tok); !errors.Is(err, ErrRevoked) {
+		t.Errorf("err = %v, want ErrRevoked", err)
+	}
+}
+
+func TestMiddleware_RejectsRevoked(t *testing.T) {
+	auth, _ := newRevokingAuth(t)
+	tok, _ := auth.IssueToken("alice", time.Hour)
+	auth.Revocations.RevokeSubject("alice")
+
+	req := httptest.NewRequest("POST", "/generate", nil)
+	req.Header.Set("Authorization", "Bearer "+tok)
+	rec := httptest.NewRecorder()
+	auth.Middleware(nil).ServeHTTP(rec, req)
+	if rec.Code != 401 || !strings.Contains(rec.Body.String(), "revoked") {
+		t.Errorf("got %d %s", rec.Code, rec.Body)
+	}
+}
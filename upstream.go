@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Load balancing strategies for UpstreamPool.
+const (
+	RoundRobin       = "round_robin"
+	LeastOutstanding = "least_outstanding"
+	PowerOfTwo       = "p2c"
+)
+
+// Upstream is one mandelbrot container behind the pool.
+type Upstream struct {
+	URL *url.URL
+
+	outstanding atomic.Int64
+
+	mu           sync.Mutex
+	fails        int // consecutive failures
+	passes       int // consecutive successes
+	ejectedUntil time.Time
+}
+
+func (u *Upstream) available(now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return now.After(u.ejectedUntil)
+}
+
+// UpstreamPool spreads requests over several upstreams and keeps track of
+// which ones are healthy. Health comes from two places: proxied requests
+// that fail to connect or get a 502/503/504 (passive), and periodic GETs
+// of HealthPath (active). Fall failures in a row eject an upstream for
+// EjectFor; after that it gets traffic again, or sooner if Rise active
+// checks in a row pass. When every upstream is ejected the pool uses all
+// of them rather than failing everything.
+type UpstreamPool struct {
+	Fall       int
+	Rise       int
+	EjectFor   time.Duration
+	HealthPath string
+
+	strategy string
+	next     atomic.Uint64
+	proxy    *httputil.ReverseProxy
+
+	mu        sync.RWMutex
+	upstreams []*Upstream
+
+	statsMu    sync.Mutex
+	latencySum time.Duration
+	latencyN   int
+}
+
+type upstreamKey struct{}
+
+func NewUpstreamPool(strategy string, targets []*url.URL, listenAddr string) (*UpstreamPool, error) {
+	switch strategy {
+	case RoundRobin, LeastOutstanding, PowerOfTwo:
+	default:
+		return nil, fmt.Errorf("unknown load balancing strategy %q", strategy)
+	}
+	p := &UpstreamPool{
+		Fall:       3,
+		Rise:       2,
+		EjectFor:   30 * time.Second,
+		HealthPath: "/",
+		strategy:   strategy,
+	}
+	for _, t := range targets {
+		p.upstreams = append(p.upstreams, &Upstream{URL: t})
+	}
+	p.proxy = &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			u := r.Context().Value(upstreamKey{}).(*Upstream)
+			r.URL.Scheme, r.URL.Host = u.URL.Scheme, u.URL.Host
+			if _, ok := r.Header["User-Agent"]; !ok {
+				// Same as NewSingleHostReverseProxy: don't let Go add one.
+				r.Header.Set("User-Agent", "")
+			}
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			u := r.Context().Value(upstreamKey{}).(*Upstream)
+			slog.Error("proxy", "path", r.URL.Path, "upstream", u.URL.Host, "err", err)
+			// A client hanging up says nothing about the upstream.
+			if r.Context().Err() == nil {
+				p.observe(u, false, false)
+			}
+			jsonError(w, http.StatusBadGateway, "upstream unavailable")
+		},
+		ModifyResponse: p.modifyResponse(proxyOrigin(listenAddr)),
+	}
+	return p, nil
+}
+
+// proxyOrigin works out the public-facing origin for Location rewrites.
+// listenAddr is typically ":9090", so we need "http://localhost:9090".
+// A full origin ("https://...") is taken as-is.
+func proxyOrigin(listenAddr string) string {
+	if strings.Contains(listenAddr, "://") {
+		return listenAddr
+	}
+	host := listenAddr
+	if strings.HasPrefix(host, ":") {
+		host = "localhost" + host
+	}
+	return "http://" + host
+}
+
+func (p *UpstreamPool) modifyResponse(origin string) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		u := resp.Request.Context().Value(upstreamKey{}).(*Upstream)
+		switch resp.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			p.observe(u, false, false)
+		default:
+			p.observe(u, true, false)
+		}
+
+		loc := resp.Header.Get("Location")
+		if loc == "" {
+			return nil
+		}
+		// Only rewrite if the Location points at the upstream.
+		upstreamOrigin := u.URL.Scheme + "://" + u.URL.Host
+		if strings.HasPrefix(loc, upstreamOrigin) {
+			rewritten := origin + loc[len(upstreamOrigin):]
+			resp.Header.Set("Location", rewritten)
+			slog.Debug("rewrote redirect", "from", loc, "to", rewritten)
+		}
+		return nil
+	}
+}
+
+// Add puts target into rotation. It is a no-op if it's already there.
+func (p *UpstreamPool) Add(target *url.URL) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, u := range p.upstreams {
+		if u.URL.String() == target.String() {
+			return
+		}
+	}
+	p.upstreams = append(p.upstreams, &Upstream{URL: target})
+	slog.Info("upstream added", "upstream", target.Host)
+}
+
+// Remove takes target out of rotation. Requests already on their way to
+// it are unaffected.
+func (p *UpstreamPool) Remove(target *url.URL) {
+	p.remove(target)
+}
+
+func (p *UpstreamPool) remove(target *url.URL) *Upstream {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	i := slices.IndexFunc(p.upstreams, func(u *Upstream) bool {
+		return u.URL.String() == target.String()
+	})
+	if i < 0 {
+		return nil
+	}
+	u := p.upstreams[i]
+	p.upstreams = slices.Delete(p.upstreams, i, i+1)
+	slog.Info("upstream removed", "upstream", target.Host)
+	return u
+}
+
+// Drain takes target out of rotation and waits for its in-flight
+// requests to finish, or for ctx to end.
+func (p *UpstreamPool) Drain(ctx context.Context, target *url.URL) error {
+	u := p.remove(target)
+	if u == nil {
+		return nil
+	}
+	tick := time.NewTicker(50 * time.Millisecond)
+	defer tick.Stop()
+	for u.outstanding.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("drain %s: %d requests still in flight: %w", target.Host, u.outstanding.Load(), ctx.Err())
+		case <-tick.C:
+		}
+	}
+	return nil
+}
+
+// Outstanding returns the in-flight requests per upstream, by URL.
+func (p *UpstreamPool) Outstanding() map[string]int64 {
+	out := map[string]int64{}
+	for _, u := range p.snapshot() {
+		out[u.URL.String()] = u.outstanding.Load()
+	}
+	return out
+}
+
+// TakeLatency returns the mean time /generate requests took since the
+// last call, and how many there were.
+func (p *UpstreamPool) TakeLatency() (time.Duration, int) {
+	p.statsMu.Lock()
+	defer p.statsMu.Unlock()
+	sum, n := p.latencySum, p.latencyN
+	p.latencySum, p.latencyN = 0, 0
+	if n == 0 {
+		return 0, 0
+	}
+	return sum / time.Duration(n), n
+}
+
+func (p *UpstreamPool) snapshot() []*Upstream {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return slices.Clone(p.upstreams)
+}
+
+func (p *UpstreamPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u := p.pick()
+	if u == nil {
+		jsonError(w, http.StatusServiceUnavailable, "no upstreams")
+		return
+	}
+	u.outstanding.Add(1)
+	defer u.outstanding.Add(-1)
+	if li := logInfoFrom(r.Context()); li != nil {
+		li.upstream = u.URL.Host
+	}
+	if isGeneratePath(r.URL.Path) {
+		start := time.Now()
+		defer func() {
+			p.statsMu.Lock()
+			p.latencySum += time.Since(start)
+			p.latencyN++
+			p.statsMu.Unlock()
+		}()
+	}
+	p.proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), upstreamKey{}, u)))
+}
+
+func (p *UpstreamPool) pick() *Upstream {
+	now := time.Now()
+	all := p.snapshot()
+	candidates := make([]*Upstream, 0, len(all))
+	for _, u := range all {
+		if u.available(now) {
+			candidates = append(candidates, u)
+		}
+	}
+	switch {
+	case len(all) == 0:
+		return nil
+	case len(candidates) == 0:
+		slog.Warn("all upstreams ejected, using them anyway")
+		candidates = all
+	}
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+
+	switch p.strategy {
+	case LeastOutstanding:
+		// Start at a rotating offset so ties don't all land on the first.
+		off := int(p.next.Add(1))
+		best := candidates[off%len(candidates)]
+		for i := range candidates {
+			c := candidates[(off+i)%len(candidates)]
+			if c.outstanding.Load() < best.outstanding.Load() {
+				best = c
+			}
+		}
+		return best
+	case PowerOfTwo:
+		i := rand.IntN(len(candidates))
+		j := rand.IntN(len(candidates) - 1)
+		if j >= i {
+			j++
+		}
+		a, b := candidates[i], candidates[j]
+		if b.outstanding.Load() < a.outstanding.Load() {
+			return b
+		}
+		return a
+	default:
+		return candidates[int(p.next.Add(1)-1)%len(candidates)]
+	}
+}
+
+// observe feeds one health observation into u. active says it came from a
+// health check rather than live traffic.
+func (p *UpstreamPool) observe(u *Upstream, ok, active bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	now := time.Now()
+	ejected := !u.ejectedUntil.IsZero()
+
+	if !ok {
+		u.fails++
+		u.passes = 0
+		if u.fails >= p.Fall && now.After(u.ejectedUntil) {
+			u.ejectedUntil = now.Add(p.EjectFor)
+			if !ejected {
+				slog.Warn("upstream ejected", "upstream", u.URL.Host, "failures", u.fails)
+			}
+		}
+		return
+	}
+
+	u.fails = 0
+	u.passes++
+	// Traffic only reaches an ejected upstream once its time is up, so a
+	// passive success is enough to bring it back.
+	if ejected && (!active || u.passes >= p.Rise) {
+		u.ejectedUntil = time.Time{}
+		slog.Info("upstream reinstated", "upstream", u.URL.Host)
+	}
+}
+
+// RunHealthChecks GETs HealthPath on every upstream each interval.
+func (p *UpstreamPool) RunHealthChecks(ctx context.Context, every time.Duration) {
+	hc := &http.Client{Timeout: 2 * time.Second}
+	tick := time.NewTicker(every)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			var wg sync.WaitGroup
+			for _, u := range p.snapshot() {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					p.observe(u, p.check(ctx, hc, u), true)
+				}()
+			}
+			wg.Wait()
+		}
+	}
+}
+
+func (p *UpstreamPool) check(ctx context.Context, hc *http.Client, u *Upstream) bool {
+	req, _ := http.NewRequestWithContext(ctx, "GET", u.URL.JoinPath(p.HealthPath).String(), nil)
+	resp, err := hc.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode < 400
+}
+
+type upstreamStatus struct {
+	URL          string    `json:"url"`
+	Healthy      bool      `json:"healthy"`
+	Outstanding  int64     `json:"outstanding"`
+	Failures     int       `json:"consecutive_failures"`
+	EjectedUntil time.Time `json:"ejected_until,omitzero"`
+}
+
+// GET /admin/upstreams
+func (p *UpstreamPool) HandleStatus(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	all := p.snapshot()
+	out := make([]upstreamStatus, 0, len(all))
+	for _, u := range all {
+		u.mu.Lock()
+		out = append(out, upstreamStatus{
+			URL:          u.URL.String(),
+			Healthy:      now.After(u.ejectedUntil),
+			Outstanding:  u.outstanding.Load(),
+			Failures:     u.fails,
+			EjectedUntil: u.ejectedUntil,
+		})
+		u.mu.Unlock()
+	}
+	writeJSON(w, http.StatusOK, out)
+}
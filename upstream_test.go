@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testBackend struct {
+	*httptest.Server
+	hits atomic.Int64
+}
+
+func newTestBackends(t *testing.T, n int, h http.HandlerFunc) ([]*testBackend, []*url.URL) {
+	t.Helper()
+	var backends []*testBackend
+	var urls []*url.URL
+	for range n {
+		b := &testBackend{}
+		b.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b.hits.Add(1)
+			if h != nil {
+				h(w, r)
+			}
+		}))
+		t.Cleanup(b.Close)
+		u, _ := url.Parse(b.URL)
+		backends, urls = append(backends, b), append(urls, u)
+	}
+	return backends, urls
+}
+
+func serveGET(h http.Handler, path string) int {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+	return rec.Code
+}
+
+func TestUpstreamPool_RoundRobin(t *testing.T) {
+	backends, urls := newTestBackends(t, 3, nil)
+	pool, err := NewUpstreamPool(RoundRobin, urls, ":9090")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 9 {
+		serveGET(pool, "/")
+	}
+	for i, b := range backends {
+		if n := b.hits.Load(); n != 3 {
+			t.Errorf("backend %d got %d requests, want 3", i, n)
+		}
+	}
+}
+
+func TestUpstreamPool_AvoidsBusy(t *testing.T) {
+	for _, strategy := range []string{LeastOutstanding, PowerOfTwo} {
+		t.Run(strategy, func(t *testing.T) {
+			release := make(chan struct{})
+			var once sync.Once
+			started := make(chan struct{})
+			backends, urls := newTestBackends(t, 2, func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/slow" {
+					once.Do(func() { close(started) })
+					<-release
+				}
+			})
+			pool, _ := NewUpstreamPool(strategy, urls, ":9090")
+
+			done := make(chan struct{})
+			go func() {
+				serveGET(pool, "/slow")
+				close(done)
+			}()
+			<-started
+			busy := 0
+			if backends[1].hits.Load() == 1 {
+				busy = 1
+			}
+
+			for range 6 {
+				serveGET(pool, "/")
+			}
+			close(release)
+			<-done
+			if n := backends[busy].hits.Load(); n != 1 {
+				t.Errorf("busy backend got %d more requests", n-1)
+			}
+		})
+	}
+}
+
+func TestUpstreamPool_EjectAndReinstate(t *testing.T) {
+	backends, urls := newTestBackends(t, 2, nil)
+	var down atomic.Bool
+	down.Store(true)
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer flaky.Close()
+	fu, _ := url.Parse(flaky.URL)
+
+	pool, _ := NewUpstreamPool(RoundRobin, append(urls, fu), ":9090")
+	pool.EjectFor = time.Hour
+
+	for range 9 {
+		serveGET(pool, "/")
+	}
+	// The flaky one got its 3 strikes and is out.
+	before := backends[0].hits.Load() + backends[1].hits.Load()
+	for range 4 {
+		if code := serveGET(pool, "/"); code != 200 {
+			t.Fatalf("status = %d after ejection", code)
+		}
+	}
+	if n := backends[0].hits.Load() + backends[1].hits.Load(); n != before+4 {
+		t.Errorf("healthy backends got %d of 4 requests", n-before)
+	}
+
+	rec := httptest.NewRecorder()
+	pool.HandleStatus(rec, httptest.NewRequest("GET", "/admin/upstreams", nil))
+	var status []upstreamStatus
+	json.NewDecoder(rec.Body).Decode(&status)
+	if len(status) != 3 || status[2].Healthy || !status[0].Healthy {
+		t.Errorf("status = %+v", status)
+	}
+
+	down.Store(false)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go pool.RunHealthChecks(ctx, 10*time.Millisecond)
+	deadline := time.Now().Add(2 * time.Second)
+	for !pool.upstreams[2].available(time.Now()) {
+		if time.Now().After(deadline) {
+			t.Fatal("upstream not reinstated by health checks")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUpstreamPool_AllEjected(t *testing.T) {
+	_, urls := newTestBackends(t, 1, nil)
+	dead, _ := url.Parse("http://127.0.0.1:1")
+	pool, _ := NewUpstreamPool(RoundRobin, []*url.URL{dead, urls[0]}, ":9090")
+	pool.Fall = 1
+	for _, u := range pool.upstreams {
+		pool.observe(u, false, true)
+	}
+	// Both ejected; the pool still tries rather than refusing outright.
+	codes := map[int]int{}
+	for range 4 {
+		codes[serveGET(pool, "/")]++
+	}
+	if codes[200] == 0 {
+		t.Errorf("codes = %v, want some 200s", codes)
+	}
+}
+
+func TestNewUpstreamPool_BadStrategy(t *testing.T) {
+	u, _ := url.Parse("http://127.0.0.1:8080")
+	if _, err := NewUpstreamPool("random", []*url.URL{u}, ":9090"); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestUpstreamPool_AddRemove(t *testing.T) {
+	backends, urls := newTestBackends(t, 2, nil)
+	pool, _ := NewUpstreamPool(RoundRobin, nil, ":9090")
+	if code := serveGET(pool, "/"); code != 503 {
+		t.Errorf("empty pool: status = %d, want 503", code)
+	}
+
+	pool.Add(urls[0])
+	pool.Add(urls[1])
+	pool.Add(urls[1])
+	for range 4 {
+		serveGET(pool, "/")
+	}
+	if a, b := backends[0].hits.Load(), backends[1].hits.Load(); a != 2 || b != 2 {
+		t.Errorf("hits = %d, %d", a, b)
+	}
+
+	pool.Remove(urls[0])
+	for range 2 {
+		serveGET(pool, "/")
+	}
+	if n := backends[0].hits.Load(); n != 2 {
+		t.Errorf("removed upstream got %d more requests", n-2)
+	}
+}
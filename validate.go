@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// GenerateLimits bounds what a render request may ask for, whoever sends
+// it. Per-token limits on top of these are Entitlements.
+type GenerateLimits struct {
+	MaxWidth      int64
+	MaxHeight     int64
+	MaxIterations int64
+	Kinds         []string
+}
+
+// FieldError is one thing wrong with a render request.
+type FieldError struct {
+	Field string `json:"field"`
+	Error string `json:"error"`
+}
+
+type invalidRequest struct {
+	Error  string       `json:"error"`
+	Fields []FieldError `json:"fields"`
+}
+
+type schemaField struct {
+	name string
+	dst  any    // where the value decodes to
+	typ  string // for "must be ..."
+}
+
+// Validate parses body as a GenerateRequest and checks it against l. It
+// reports every bad field rather than stopping at the first, including
+// fields of the wrong type and fields the container doesn't know.
+func (l *GenerateLimits) Validate(body []byte) (*GenerateRequest, []FieldError) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(body, &raw); err != nil || raw == nil {
+		return nil, []FieldError{{Field: "", Error: "body must be a JSON object"}}
+	}
+
+	var req GenerateRequest
+	schema := []schemaField{
+		{"width", &req.Width, "an integer"},
+		{"height", &req.Height, "an integer"},
+		{"iterations", &req.Iterations, "an integer"},
+		{"re_min", &req.ReMin, "a number"},
+		{"re_max", &req.ReMax, "a number"},
+		{"im_min", &req.ImMin, "a number"},
+		{"im_max", &req.ImMax, "a number"},
+		{"kind", &req.Kind, "a string"},
+	}
+
+	var errs []FieldError
+	bad := map[string]bool{}
+	fail := func(field, format string, args ...any) {
+		errs = append(errs, FieldError{Field: field, Error: fmt.Sprintf(format, args...)})
+		bad[field] = true
+	}
+	known := map[string]bool{}
+	for _, f := range schema {
+		known[f.name] = true
+		v, ok := raw[f.name]
+		switch {
+		case !ok:
+			fail(f.name, "required")
+		case json.Unmarshal(v, f.dst) != nil:
+			fail(f.name, "must be %s", f.typ)
+		}
+	}
+	var unknown []string
+	for name := range raw {
+		if !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		fail(name, "unknown field")
+	}
+
+	checkRange := func(field string, v, hi int64) {
+		if !bad[field] && (v < 1 || v > hi) {
+			fail(field, "must be between 1 and %d", hi)
+		}
+	}
+	checkRange("width", req.Width, l.MaxWidth)
+	checkRange("height", req.Height, l.MaxHeight)
+	checkRange("iterations", req.Iterations, l.MaxIterations)
+	if !bad["re_min"] && !bad["re_max"] && req.ReMin >= req.ReMax {
+		fail("re_max", "must be greater than re_min")
+	}
+	if !bad["im_min"] && !bad["im_max"] && req.ImMin >= req.ImMax {
+		fail("im_max", "must be greater than im_min")
+	}
+	if !bad["kind"] && !slices.Contains(l.Kinds, req.Kind) {
+		fail("kind", "must be one of %s", strings.Join(l.Kinds, ", "))
+	}
+
+	if len(errs) > 0 {
+		// In schema order, unknown fields last.
+		order := func(field string) int {
+			if i := slices.IndexFunc(schema, func(f schemaField) bool { return f.name == field }); i >= 0 {
+				return i
+			}
+			return len(schema)
+		}
+		sort.SliceStable(errs, func(i, j int) bool { return order(errs[i].Field) < order(errs[j].Field) })
+		return nil, errs
+	}
+	return &req, nil
+}
+
+func writeInvalid(w http.ResponseWriter, errs []FieldError) {
+	writeJSON(w, http.StatusBadRequest, invalidRequest{Error: "invalid render request", Fields: errs})
+}
+
+// Handler rejects POST /generate bodies that fail Validate with a 400
+// listing the bad fields, so they never reach the container.
+func (l *GenerateLimits) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || !isGeneratePath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		body, err := readGenerateBody(r)
+		if err != nil {
+			jsonError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if _, errs := l.Validate(body); errs != nil {
+			slog.Debug("invalid render request", "fields", len(errs))
+			writeInvalid(w, errs)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var testLimits = &GenerateLimits{MaxWidth: 1000, MaxHeight: 1000, MaxIterations: 500, Kinds: []string{"png", "jpeg"}}
+
+func TestGenerateLimits_Validate(t *testing.T) {
+	cases := []struct {
+		name string
+		body string
+		want []FieldError
+	}{
+		{"valid", renderBody, nil},
+		{"not an object", `[1,2]`, []FieldError{{"", "body must be a JSON object"}}},
+		{"negative width", strings.Replace(renderBody, `"width":640`, `"width":-5`, 1),
+			[]FieldError{{"width", "must be between 1 and 1000"}}},
+		{"too many iterations", strings.Replace(renderBody, `"iterations":100`, `"iterations":100000`, 1),
+			[]FieldError{{"iterations", "must be between 1 and 500"}}},
+		{"inverted bounds", strings.Replace(renderBody, `"re_min":-2,"re_max":1`, `"re_min":1,"re_max":-2`, 1),
+			[]FieldError{{"re_max", "must be greater than re_min"}}},
+		{"unknown kind", strings.Replace(renderBody, `"png"`, `"gif"`, 1),
+			[]FieldError{{"kind", "must be one of png, jpeg"}}},
+		{"wrong types", strings.Replace(renderBody, `"width":640,"height":480`, `"width":"640","height":48.5`, 1),
+			[]FieldError{{"width", "must be an integer"}, {"height", "must be an integer"}}},
+		{"unknown field", strings.Replace(renderBody, `"kind"`, `"colour":"red","kind"`, 1),
+			[]FieldError{{"colour", "unknown field"}}},
+		{"several", `{"width":0,"height":480,"iterations":100,"re_min":0,"re_max":0,"im_min":-1,"im_max":1,"kind":"bmp"}`,
+			[]FieldError{
+				{"width", "must be between 1 and 1000"},
+				{"re_max", "must be greater than re_min"},
+				{"kind", "must be one of png, jpeg"},
+			}},
+		{"missing", `{"width":64,"height":64}`, []FieldError{
+			{"iterations", "required"},
+			{"re_min", "required"},
+			{"re_max", "required"},
+			{"im_min", "required"},
+			{"im_max", "required"},
+			{"kind", "required"},
+		}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, errs := testLimits.Validate([]byte(tc.body))
+			if !reflect.DeepEqual(errs, tc.want) {
+				t.Errorf("errors = %+v\nwant %+v", errs, tc.want)
+			}
+			if (req != nil) != (tc.want == nil) {
+				t.Errorf("request = %+v", req)
+			}
+		})
+	}
+}
+
+func TestGenerateLimits_Handler(t *testing.T) {
+	var forwarded int
+	h := testLimits.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { forwarded++ }))
+
+	rec := postGenerate(h, "/generate/", renderBody)
+	if rec.Code != 200 || forwarded != 1 {
+		t.Errorf("valid body: status %d, forwarded %d", rec.Code, forwarded)
+	}
+
+	rec = postGenerate(h, "/generate", `{"width":-1}`)
+	if rec.Code != 400 || forwarded != 1 {
+		t.Fatalf("invalid body: status %d, forwarded %d", rec.Code, forwarded)
+	}
+	var resp invalidRequest
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if resp.Error == "" || len(resp.Fields) != 8 || resp.Fields[0].Field != "width" {
+		t.Errorf("response = %+v", resp)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != 200 || forwarded != 2 {
+		t.Errorf("other path: status %d, forwarded %d", rec.Code, forwarded)
+	}
+
+	// In front of Authorize, as main wires it, a malformed body is a 400
+	// whatever the caller is entitled to.
+	h = testLimits.Handler(Authorize(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { forwarded++ })))
+	req := httptest.NewRequest("POST", "/generate/", strings.NewReader(`{"width":-5,"height":100000}`))
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, withIdentity(req, &Identity{Subject: "alice", Entitlements: Entitlements{MaxPixels: 1000}}))
+	if rec.Code != 400 || forwarded != 2 {
+		t.Errorf("behind Authorize: status %d, forwarded %d", rec.Code, forwarded)
+	}
+}